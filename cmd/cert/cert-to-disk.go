@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 
 	"github.com/SAP/cloud-authorization-buildpack/pkg/common/services"
+	"github.com/SAP/cloud-authorization-buildpack/pkg/supply/env"
 )
 
 var log = &Logger{}
@@ -20,7 +21,7 @@ func main() {
 	}
 	amsStagerDepDir := os.Args[1]
 
-	cert, key, err := loadCert()
+	creds, err := loadCredentials()
 	if err != nil {
 		if errors.Is(err, ErrMegacliteMode) {
 			log.Info("AMS sidecar starting in megaclite mode, using CF instance certificate")
@@ -30,13 +31,21 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = copyCertToDisk(amsStagerDepDir, cert, key)
+	if creds.UsesClientSecret() {
+		err = copySecretToDisk(amsStagerDepDir, []byte(creds.ClientSecret))
+	} else {
+		err = copyCertToDisk(amsStagerDepDir, []byte(creds.Certificate), []byte(creds.Key))
+	}
 	if err != nil {
 		log.Error("Error starting AMS sidecar: %v", err)
 		os.Exit(1)
 	}
+	if err := copyObjectStoreCredentialsToDisk(amsStagerDepDir, creds); err != nil {
+		log.Error("Error starting AMS sidecar: %v", err)
+		os.Exit(1)
+	}
 
-	log.Info("Successfully copied ias cert to folder '%s' on disk, terminating cert-to-disk helper. This will result in an Exit status 0 in the app logs. The main AMS sidecar is not effected", amsStagerDepDir)
+	log.Info("Successfully copied ias credentials to folder '%s' on disk, terminating cert-to-disk helper. This will result in an Exit status 0 in the app logs. The main AMS sidecar is not effected", amsStagerDepDir)
 }
 
 func copyCertToDisk(amsDependencyDir string, cert, key []byte) error {
@@ -52,19 +61,48 @@ func copyCertToDisk(amsDependencyDir string, cert, key []byte) error {
 	return nil
 }
 
+// copySecretToDisk writes the client secret of the identity binding, which OPA reads with --set-file.
+func copySecretToDisk(amsDependencyDir string, secret []byte) error {
+	err := os.WriteFile(path.Join(amsDependencyDir, "ias.secret"), secret, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to write IAS client secret: %s", err)
+	}
+	return nil
+}
+
+// copyObjectStoreCredentialsToDisk writes the access keys of the object store as AWS credentials file, which OPA uses to
+// sign the bundle requests if the bundles are downloaded from the object store.
+func copyObjectStoreCredentialsToDisk(amsDependencyDir string, creds *services.IASCredentials) error {
+	bundleSource, err := env.LoadBundleSource()
+	if err != nil {
+		return err
+	}
+	if bundleSource != env.BundleSourceObjectStore || creds.AmsObjectStore == nil {
+		return nil
+	}
+	content := fmt.Sprintf("[default]\naws_access_key_id = %s\naws_secret_access_key = %s\n",
+		creds.AmsObjectStore.AccessKeyID, creds.AmsObjectStore.SecretAccessKey)
+	err = os.WriteFile(path.Join(amsDependencyDir, "aws_credentials"), []byte(content), 0600)
+	if err != nil {
+		return fmt.Errorf("unable to write object store credentials: %s", err)
+	}
+	return nil
+}
+
 var ErrMegacliteMode = errors.New("AMS sidecar starting in megaclite mode: No cert-to-disk required")
 
-func loadCert() (cert, key []byte, err error) {
-	identityCreds, err := services.LoadServiceCredentials(log)
+func loadCredentials() (*services.IASCredentials, error) {
+	// cert-to-disk runs in the app root, so relative paths like AMS_IDENTITY_KEY_FILE resolve against the working directory
+	identityCreds, err := services.LoadServiceCredentials(log, "")
 	if err != nil {
-		return nil, nil, fmt.Errorf("could not load AMSCredentials: %w", err)
+		return nil, fmt.Errorf("could not load AMSCredentials: %w", err)
 	}
 
 	if identityCreds.AmsInstanceID == services.MegacliteID {
-		return nil, nil, ErrMegacliteMode
+		return nil, ErrMegacliteMode
 	}
 
-	return []byte(identityCreds.Certificate), []byte(identityCreds.Key), nil
+	return identityCreds, nil
 }
 
 var _ services.Logger = &Logger{}
@@ -75,6 +113,10 @@ func (l *Logger) Info(format string, args ...interface{}) { //nolint:goprintffun
 	_, _ = fmt.Fprintln(os.Stdout, fmt.Sprintf(format, args...))
 }
 
+func (l *Logger) Warning(format string, args ...interface{}) { //nolint:goprintffuncname
+	_, _ = fmt.Fprintln(os.Stderr, "WARNING: "+fmt.Sprintf(format, args...))
+}
+
 func (l *Logger) Error(format string, args ...interface{}) { //nolint:goprintffuncname
 	_, _ = fmt.Fprintln(os.Stderr, fmt.Sprintf(format, args...))
 }
@@ -7,6 +7,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/SAP/cloud-authorization-buildpack/pkg/common/services"
 	"github.com/SAP/cloud-authorization-buildpack/resources/testdata"
 )
 
@@ -27,30 +28,78 @@ func Test_copyCertToDisk(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-func Test_loadCert(t *testing.T) {
+func Test_copySecretToDisk(t *testing.T) {
+	depsDir := t.TempDir()
+	assert.NoError(t, copySecretToDisk(depsDir, []byte("hello secret")))
+
+	secret, err := os.ReadFile(path.Join(depsDir, "ias.secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello secret"), secret)
+	fi, err := os.Stat(path.Join(depsDir, "ias.secret"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
+
+func Test_loadCredentials(t *testing.T) {
+	keyFile := path.Join(t.TempDir(), "ias.key")
+	assert.NoError(t, os.WriteFile(keyFile, []byte(testdata.ProvidedKey), 0600))
+	servicebindingCert := readBindingFile(t, "certificate")
+	servicebindingKey := readBindingFile(t, "key")
+	vcapFile := path.Join(t.TempDir(), "vcap_services.json")
+	assert.NoError(t, os.WriteFile(vcapFile, []byte(testdata.EnvWithIASAuthX509), 0600))
+
 	tests := []struct {
-		name     string
-		testdata string
-		wantCert []byte
-		wantKey  []byte
-		wantErr  assert.ErrorAssertionFunc
+		name        string
+		testdata    string
+		serviceName string
+		bindingRoot string
+		vcapFile    string
+		keyEnv      map[string]string
+		wantCert    []byte
+		wantKey     []byte
+		wantSecret  string
+		wantErr     assert.ErrorAssertionFunc
 	}{
-		{name: "IAS X509", testdata: testdata.EnvWithIASAuthX509, wantCert: []byte("identity-cert-payload"), wantKey: []byte("identity-key-payload"), wantErr: assert.NoError},
+		{name: "IAS X509", testdata: testdata.EnvWithIASAuthX509, wantCert: []byte(testdata.IdentityCert), wantKey: []byte(testdata.IdentityKey), wantErr: assert.NoError},
 		{name: "IAS X509 Expired", testdata: testdata.EnvWithIASAuthX509Expired, wantCert: nil, wantKey: nil, wantErr: assert.Error},
 		{name: "Env with megaclite", testdata: testdata.EnvWithMegaclite, wantCert: nil, wantKey: nil, wantErr: assertErrorIsMegacliteMode},
-		{name: "User-provided IAS X509", testdata: testdata.EnvWithUserProvidedIAS, wantCert: []byte("identity-cert-payload"), wantKey: []byte("identity-key-payload"), wantErr: assert.NoError},
+		{name: "User-provided IAS X509", testdata: testdata.EnvWithUserProvidedIAS, wantCert: []byte(testdata.IdentityCert), wantKey: []byte(testdata.IdentityKey), wantErr: assert.NoError},
 		{name: "Service binding missing", testdata: testdata.EnvWithAllMissing, wantCert: nil, wantKey: nil, wantErr: assert.Error},
+		{name: "Multiple IAS without service name", testdata: testdata.EnvWithMultipleIAS, wantCert: nil, wantKey: nil, wantErr: assert.Error},
+		{name: "Multiple IAS selected by name", testdata: testdata.EnvWithMultipleIAS, serviceName: "ias-ams-node", wantCert: []byte(testdata.IdentityCert), wantKey: []byte(testdata.IdentityKey), wantErr: assert.NoError},
+		{name: "Multiple IAS selected by instance name", testdata: testdata.EnvWithMultipleIAS, serviceName: "ias-login", wantCert: []byte(testdata.LoginCert), wantKey: []byte(testdata.LoginKey), wantErr: assert.NoError},
+		{name: "Multiple IAS selected by tag", testdata: testdata.EnvWithMultipleIAS, serviceName: "login", wantCert: []byte(testdata.LoginCert), wantKey: []byte(testdata.LoginKey), wantErr: assert.NoError},
+		{name: "SAP BTP secret mount", bindingRoot: testdata.K8sBindingRoot("sapbtp"), wantCert: []byte(testdata.IdentityCert), wantKey: []byte(testdata.IdentityKey), wantErr: assert.NoError},
+		{name: "SAP BTP secret mount selected by tag", bindingRoot: testdata.K8sBindingRoot("sapbtp"), serviceName: "ams", wantCert: []byte(testdata.IdentityCert), wantKey: []byte(testdata.IdentityKey), wantErr: assert.NoError},
+		{name: "servicebinding.io", bindingRoot: testdata.K8sBindingRoot("servicebinding"), wantCert: servicebindingCert, wantKey: servicebindingKey, wantErr: assert.NoError},
+		{name: "Empty binding root", bindingRoot: t.TempDir(), wantCert: nil, wantKey: nil, wantErr: assert.Error},
+		{name: "IAS X509 provided without key", testdata: testdata.EnvWithIASAuthX509Provided, wantCert: nil, wantKey: nil, wantErr: assert.Error},
+		{name: "IAS X509 provided with key from env", testdata: testdata.EnvWithIASAuthX509Provided, keyEnv: map[string]string{"AMS_IDENTITY_KEY": testdata.ProvidedKey}, wantCert: []byte(testdata.ProvidedCert), wantKey: []byte(testdata.ProvidedKey), wantErr: assert.NoError},
+		{name: "IAS X509 provided with key from file", testdata: testdata.EnvWithIASAuthX509Provided, keyEnv: map[string]string{"AMS_IDENTITY_KEY_FILE": keyFile}, wantCert: []byte(testdata.ProvidedCert), wantKey: []byte(testdata.ProvidedKey), wantErr: assert.NoError},
+		{name: "IAS X509 provided with missing key file", testdata: testdata.EnvWithIASAuthX509Provided, keyEnv: map[string]string{"AMS_IDENTITY_KEY_FILE": keyFile + ".missing"}, wantCert: nil, wantKey: nil, wantErr: assert.Error},
+		{name: "IAS X509 provided with ambiguous key", testdata: testdata.EnvWithIASAuthX509Provided, keyEnv: map[string]string{"AMS_IDENTITY_KEY_FILE": keyFile, "AMS_IDENTITY_KEY": testdata.ProvidedKey}, wantCert: nil, wantKey: nil, wantErr: assert.Error},
+		{name: "IAS X509 provided with key of another certificate", testdata: testdata.EnvWithIASAuthX509Provided, keyEnv: map[string]string{"AMS_IDENTITY_KEY": testdata.LoginKey}, wantCert: nil, wantKey: nil, wantErr: assert.Error},
+		{name: "VCAP_SERVICES_FILE_PATH", vcapFile: vcapFile, wantCert: []byte(testdata.IdentityCert), wantKey: []byte(testdata.IdentityKey), wantErr: assert.NoError},
+		{name: "VCAP_SERVICES_FILE_PATH missing", vcapFile: vcapFile + ".missing", wantCert: nil, wantKey: nil, wantErr: assert.Error},
+		{name: "IAS with client secret", testdata: testdata.EnvWithIASAuthWithClientSecret, wantCert: []byte{}, wantKey: []byte{}, wantSecret: "mysecret", wantErr: assert.NoError},
+		{name: "Multiple IAS with unknown service name", testdata: testdata.EnvWithMultipleIAS, serviceName: "unknown", wantCert: nil, wantKey: nil, wantErr: assert.Error},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			t.Setenv("VCAP_SERVICES", tt.testdata)
+			t.Setenv("AMS_IDENTITY_SERVICE_NAME", tt.serviceName)
+			t.Setenv("SERVICE_BINDING_ROOT", tt.bindingRoot)
+			t.Setenv("VCAP_SERVICES_FILE_PATH", tt.vcapFile)
+			t.Setenv("AMS_IDENTITY_KEY", tt.keyEnv["AMS_IDENTITY_KEY"])
+			t.Setenv("AMS_IDENTITY_KEY_FILE", tt.keyEnv["AMS_IDENTITY_KEY_FILE"])
 
-			gotCert, gotKey, err := loadCert()
-			if !tt.wantErr(t, err, "loadCert()") {
+			creds, err := loadCredentials()
+			if !tt.wantErr(t, err, "loadCredentials()") || err != nil {
 				return
 			}
-			assert.Equalf(t, tt.wantCert, gotCert, "loadCert()")
-			assert.Equalf(t, tt.wantKey, gotKey, "loadCert()")
+			assert.Equalf(t, tt.wantCert, []byte(creds.Certificate), "loadCredentials()")
+			assert.Equalf(t, tt.wantKey, []byte(creds.Key), "loadCredentials()")
+			assert.Equalf(t, tt.wantSecret, creds.ClientSecret, "loadCredentials()")
 		})
 	}
 }
@@ -58,3 +107,44 @@ func Test_loadCert(t *testing.T) {
 func assertErrorIsMegacliteMode(t assert.TestingT, err error, msgAndArgs ...interface{}) bool {
 	return assert.ErrorIs(t, ErrMegacliteMode, err, msgAndArgs)
 }
+
+func readBindingFile(t *testing.T, key string) []byte {
+	b, err := os.ReadFile(path.Join(testdata.K8sBindingRoot("servicebinding"), "my-identity", key))
+	assert.NoError(t, err)
+	return b
+}
+
+func Test_copyObjectStoreCredentialsToDisk(t *testing.T) {
+	store := &services.ObjectStoreCredentials{AccessKeyID: "my-access-key", SecretAccessKey: "my-secret-key"}
+	tests := []struct {
+		name         string
+		bundleSource string
+		store        *services.ObjectStoreCredentials
+		want         string
+		wantErr      assert.ErrorAssertionFunc
+	}{
+		{name: "bundle gateway", bundleSource: "", store: store, wantErr: assert.NoError},
+		{name: "object store", bundleSource: "object-store", store: store,
+			want: "[default]\naws_access_key_id = my-access-key\naws_secret_access_key = my-secret-key\n", wantErr: assert.NoError},
+		{name: "object store without credentials", bundleSource: "object-store", wantErr: assert.NoError},
+		{name: "invalid bundle source", bundleSource: "ftp", store: store, wantErr: assert.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AMS_BUNDLE_SOURCE", tt.bundleSource)
+			depsDir := t.TempDir()
+
+			err := copyObjectStoreCredentialsToDisk(depsDir, &services.IASCredentials{AmsObjectStore: tt.store})
+			if !tt.wantErr(t, err) || err != nil {
+				return
+			}
+			got, err := os.ReadFile(path.Join(depsDir, "aws_credentials"))
+			if tt.want == "" {
+				assert.ErrorIs(t, err, os.ErrNotExist)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+
+	"github.com/SAP/cloud-authorization-buildpack/pkg/dcl"
+	"github.com/SAP/cloud-authorization-buildpack/pkg/uploader"
+)
+
+// dcl-check validates the DCL files below a directory without uploading them, e.g. as a CI step.
+func main() {
+	logger := libbuildpack.NewLogger(os.Stdout)
+	if len(os.Args) < 2 {
+		logger.Error("Missing DCL root directory argument\n\nUsage: %s <dcl-root>[,<dcl-root>...] [<include-pattern>...]", os.Args[0])
+		os.Exit(2)
+	}
+	roots := strings.Split(os.Args[1], ",")
+
+	issues, err := dcl.Validate(roots, uploader.FileFilter{Include: os.Args[2:]})
+	if err != nil {
+		logger.Error("Could not validate DCLs: %s", err)
+		os.Exit(2)
+	}
+	uploader.IssuePrinter{Log: logger, Roots: roots, ContextLines: uploader.DefaultContextLines}.Print(issues)
+	if n := dcl.CountErrors(issues); n > 0 {
+		logger.Error("DCL validation failed with %d error(s)", n)
+		os.Exit(1)
+	}
+	logger.Info("DCL validation succeeded")
+}
@@ -4,19 +4,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
-	"time"
+	"os"
+	"path/filepath"
 
 	"github.com/go-playground/validator/v10"
 )
 
-func fromMegaclite(log Logger) (*IASCredentials, error) {
-	megacliteService, err := LoadService(log, "megaclite")
-	if err != nil {
-		return nil, err
-	}
-
+func megacliteCredentials(raw json.RawMessage) (*IASCredentials, error) {
 	var megacliteCreds MegacliteCredentials
-	err = json.Unmarshal(megacliteService.Credentials, &megacliteCreds)
+	err := json.Unmarshal(raw, &megacliteCreds)
 	if err != nil {
 		return nil, fmt.Errorf("error unmarshaling identity credentials: %w", err)
 	}
@@ -38,28 +34,53 @@ func fromMegaclite(log Logger) (*IASCredentials, error) {
 	return &result, nil
 }
 
-func fromIdentity(log Logger) (*IASCredentials, error) {
-	iasService, err := LoadService(log, "identity")
-	if err != nil {
-		return nil, err
-	}
+const (
+	IdentityKeyEnv     = "AMS_IDENTITY_KEY"
+	IdentityKeyFileEnv = "AMS_IDENTITY_KEY_FILE"
+)
+
+// identityCredentials parses and validates the credentials of an identity binding. The private key of X509_PROVIDED
+// bindings is completed from the app configuration.
+func identityCredentials(log Logger, raw json.RawMessage, appRoot string) (*IASCredentials, error) {
 	var creds IASCredentials
-	err = json.Unmarshal(iasService.Credentials, &creds)
+	err := json.Unmarshal(raw, &creds)
 	if err != nil {
 		return nil, fmt.Errorf("error unmarshaling identity credentials: %w", err)
 	}
+	var valueHelp valueHelpCertificate
+	if err := json.Unmarshal(raw, &valueHelp); err != nil {
+		return nil, fmt.Errorf("error unmarshaling identity credentials: %w", err)
+	}
+	creds.AmsValueHelpCertIssuer = parseValueHelpName(log, valueHelpCertIssuerKey, valueHelp.Issuer)
+	creds.AmsValueHelpCertSubject = parseValueHelpName(log, valueHelpCertSubjectKey, valueHelp.Subject)
 
 	// explicit checks to improve error messages for consumer
 	if creds.AmsInstanceID == "" {
 		return nil, fmt.Errorf("identity service credentials found without activated authorization management service")
 	}
 
-	if creds.Certificate == "" || creds.Key == "" { // TODO: Remove the check for KEY once X509_PROVIDED bindings are supported
-		return nil, fmt.Errorf(`invalid bindings credentials for identity service with AMS enabled: service bindings must be created with {"credential-type": "X509_GENERATED"} (more information in the identity broker documentation)`)
+	if creds.UsesClientSecret() {
+		return withClientSecret(log, creds)
+	}
+
+	if creds.Certificate == "" {
+		return nil, fmt.Errorf(`invalid bindings credentials for identity service with AMS enabled: service bindings must be created with {"credential-type": "X509_GENERATED"} or {"credential-type": "X509_PROVIDED"}, or contain a client secret (more information in the identity broker documentation)`)
+	}
+
+	if creds.Key == "" { // X509_PROVIDED bindings only contain the certificate, its key is provided by the app
+		key, source, err := loadProvidedKey(appRoot)
+		if err != nil {
+			return nil, err
+		}
+		if key == "" {
+			return nil, fmt.Errorf(`invalid bindings credentials for identity service with AMS enabled: the binding contains no private key. For bindings created with {"credential-type": "X509_PROVIDED"}, provide the private key of the certificate in %s or %s`, IdentityKeyFileEnv, IdentityKeyEnv)
+		}
+		log.Info("using the private key from %s for the provided identity certificate", source)
+		creds.Key = key
 	}
 
-	if creds.CertificateExpiresAt.Before(time.Now()) {
-		return nil, fmt.Errorf("identity certificate has expired: %s. Please re-create your identity binding", creds.CertificateExpiresAt.String())
+	if err := CheckCertificate(log, "identity", []byte(creds.Certificate), []byte(creds.Key)); err != nil {
+		return nil, fmt.Errorf("%w. Please re-create your identity binding", err)
 	}
 
 	validate := validator.New()
@@ -72,3 +93,45 @@ func fromIdentity(log Logger) (*IASCredentials, error) {
 
 	return &creds, nil
 }
+
+// withClientSecret completes the credentials of an identity binding with a client secret, which are used to obtain
+// access tokens from the token endpoint of the identity tenant.
+func withClientSecret(log Logger, creds IASCredentials) (*IASCredentials, error) {
+	validate := validator.New()
+	if err := validate.Struct(creds); err != nil {
+		return nil, fmt.Errorf("invalid binding credentials for identity service with AMS enabled: %w", err)
+	}
+	if creds.URL == "" {
+		return nil, fmt.Errorf("invalid binding credentials for identity service with AMS enabled: the binding contains a client secret but no url of the identity tenant")
+	}
+	tokenURL, err := url.JoinPath(creds.URL, "/oauth2/token")
+	if err != nil {
+		return nil, fmt.Errorf("error building token url: %w", err)
+	}
+	log.Info("using the client secret of identity client '%s' to obtain access tokens from %s", creds.ClientID, tokenURL)
+	creds.TokenURL = tokenURL
+	creds.AmsServerURL = creds.URL
+	return &creds, nil
+}
+
+// loadProvidedKey returns the private key of a provided identity certificate and where it was loaded from. The key is
+// read from the file AMS_IDENTITY_KEY_FILE, relative paths are resolved against appRoot, or taken from AMS_IDENTITY_KEY.
+func loadProvidedKey(appRoot string) (key, source string, err error) {
+	keyFile := os.Getenv(IdentityKeyFileEnv)
+	keyValue := os.Getenv(IdentityKeyEnv)
+	switch {
+	case keyFile != "" && keyValue != "":
+		return "", "", fmt.Errorf("only one of %s and %s may be set", IdentityKeyFileEnv, IdentityKeyEnv)
+	case keyFile != "":
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(appRoot, keyFile)
+		}
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return "", "", fmt.Errorf("could not read the private key of the identity certificate from %s: %w", IdentityKeyFileEnv, err)
+		}
+		return string(b), fmt.Sprintf("%s '%s'", IdentityKeyFileEnv, keyFile), nil
+	default:
+		return keyValue, IdentityKeyEnv, nil
+	}
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CertExpiryWarningEnv configures how long before its expiry a warning about the certificate is logged.
+const CertExpiryWarningEnv = "AMS_CERT_EXPIRY_WARNING"
+
+const defaultCertExpiryWarning = 30 * 24 * time.Hour
+
+// CertificateInfo describes the leaf certificate of a client certificate chain.
+type CertificateInfo struct {
+	Subject     string
+	Issuer      string
+	Serial      string
+	NotBefore   time.Time
+	NotAfter    time.Time
+	ChainLength int
+}
+
+// InspectCertificate parses the PEM encoded certificate chain and checks that each certificate is issued by the next
+// one, that the private key belongs to the first certificate, and that the first certificate is valid at now.
+func InspectCertificate(certPEM, keyPEM []byte, now time.Time) (*CertificateInfo, error) {
+	var chain []*x509.Certificate
+	for rest := certPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse certificate %d of the chain: %w", len(chain)+1, err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	for i := 0; i+1 < len(chain); i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return nil, fmt.Errorf("certificate %d of the chain is not issued by certificate %d: %w", i+1, i+2, err)
+		}
+	}
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil, fmt.Errorf("private key does not belong to the certificate: %w", err)
+	}
+
+	leaf := chain[0]
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("certificate is not valid before %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate has expired on %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return &CertificateInfo{
+		Subject:     leaf.Subject.String(),
+		Issuer:      leaf.Issuer.String(),
+		Serial:      leaf.SerialNumber.Text(16),
+		NotBefore:   leaf.NotBefore,
+		NotAfter:    leaf.NotAfter,
+		ChainLength: len(chain),
+	}, nil
+}
+
+// CheckCertificate inspects the named client certificate, logs its details (never the key) and warns if it expires
+// within the window configured by AMS_CERT_EXPIRY_WARNING.
+func CheckCertificate(log Logger, name string, certPEM, keyPEM []byte) error {
+	window, err := certExpiryWarning()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	info, err := inspectAndLog(log, name, certPEM, keyPEM, now)
+	if err != nil {
+		return err
+	}
+	if remaining := info.NotAfter.Sub(now); remaining < window {
+		log.Warning("the %s certificate expires in %s on %s, renew it in time to avoid authorization failures",
+			name, remaining.Round(time.Minute), info.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// CheckRotatedCertificate inspects the named client certificate and logs its details like CheckCertificate, but
+// doesn't warn about its expiry, since the platform renews it automatically, like the CF instance identity.
+func CheckRotatedCertificate(log Logger, name string, certPEM, keyPEM []byte) error {
+	_, err := inspectAndLog(log, name, certPEM, keyPEM, time.Now())
+	return err
+}
+
+func inspectAndLog(log Logger, name string, certPEM, keyPEM []byte, now time.Time) (*CertificateInfo, error) {
+	info, err := InspectCertificate(certPEM, keyPEM, now)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s certificate: %w", name, err)
+	}
+	log.Info("using %s certificate with subject '%s', issuer '%s' and serial number %s, valid from %s until %s",
+		name, info.Subject, info.Issuer, info.Serial, info.NotBefore.Format(time.RFC3339), info.NotAfter.Format(time.RFC3339))
+	return info, nil
+}
+
+// certExpiryWarning returns the warning window from AMS_CERT_EXPIRY_WARNING, given as Go duration like "72h" or in
+// days like "14d".
+func certExpiryWarning() (time.Duration, error) {
+	v := os.Getenv(CertExpiryWarningEnv)
+	if v == "" {
+		return defaultCertExpiryWarning, nil
+	}
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid value for %s: %q", CertExpiryWarningEnv, v)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid value for %s: %q", CertExpiryWarningEnv, v)
+	}
+	return d, nil
+}
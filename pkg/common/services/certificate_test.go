@@ -0,0 +1,110 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SAP/cloud-authorization-buildpack/resources/testdata"
+)
+
+type recordingLogger struct{ infos, warnings []string }
+
+func (l *recordingLogger) Info(format string, args ...interface{}) {
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+}
+func (l *recordingLogger) Warning(format string, args ...interface{}) {
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+func (l *recordingLogger) Error(format string, args ...interface{}) {}
+
+func TestInspectCertificate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cert    string
+		key     string
+		now     time.Time
+		wantErr string
+	}{
+		{name: "valid chain", cert: testdata.IdentityCert, key: testdata.IdentityKey, now: time.Now()},
+		{name: "expired", cert: testdata.ExpiredCert, key: testdata.IdentityKey, now: time.Now(), wantErr: "certificate has expired on 2021-11-28T09:57:08Z"},
+		{name: "not yet valid", cert: testdata.IdentityCert, key: testdata.IdentityKey, now: time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC), wantErr: "certificate is not valid before"},
+		{name: "key of another certificate", cert: testdata.IdentityCert, key: testdata.LoginKey, now: time.Now(), wantErr: "private key does not belong to the certificate"},
+		{name: "chain in wrong order", cert: reverseChain(testdata.IdentityCert), key: testdata.IdentityKey, now: time.Now(), wantErr: "certificate 1 of the chain is not issued by certificate 2"},
+		{name: "no PEM", cert: "identity-cert-payload", key: testdata.IdentityKey, now: time.Now(), wantErr: "no PEM encoded certificate found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := InspectCertificate([]byte(tt.cert), []byte(tt.key), tt.now)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "CN=identity-test-client,OU=SAP Cloud Platform Clients,O=SAP SE,C=DE", info.Subject)
+			assert.Equal(t, "CN=AMS Test CA,O=SAP SE,C=DE", info.Issuer)
+			assert.Equal(t, "1000", info.Serial)
+			assert.Equal(t, time.Date(2040, 11, 28, 9, 57, 8, 0, time.UTC), info.NotAfter)
+			assert.Equal(t, 2, info.ChainLength)
+		})
+	}
+}
+
+func TestCheckCertificate(t *testing.T) {
+	tests := []struct {
+		name        string
+		warning     string
+		wantWarning bool
+		wantErr     bool
+	}{
+		{name: "default window", warning: ""},
+		{name: "window in days", warning: "10000d", wantWarning: true},
+		{name: "window as duration", warning: "72h"},
+		{name: "invalid window", warning: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(CertExpiryWarningEnv, tt.warning)
+			log := &recordingLogger{}
+
+			err := CheckCertificate(log, "identity", []byte(testdata.IdentityCert), []byte(testdata.IdentityKey))
+			if tt.wantErr {
+				assert.ErrorContains(t, err, CertExpiryWarningEnv)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, log.infos, 1)
+			assert.Contains(t, log.infos[0], "using identity certificate with subject 'CN=identity-test-client")
+			assert.Contains(t, log.infos[0], "serial number 1000")
+			assert.NotContains(t, log.infos[0], "PRIVATE KEY")
+			if tt.wantWarning {
+				require.Len(t, log.warnings, 1)
+				assert.Contains(t, log.warnings[0], "the identity certificate expires in")
+			} else {
+				assert.Empty(t, log.warnings)
+			}
+		})
+	}
+}
+
+func TestCheckRotatedCertificate(t *testing.T) {
+	t.Setenv(CertExpiryWarningEnv, "10000d")
+	log := &recordingLogger{}
+
+	require.NoError(t, CheckRotatedCertificate(log, "CF instance", []byte(testdata.IdentityCert), []byte(testdata.IdentityKey)))
+	require.Len(t, log.infos, 1)
+	assert.Contains(t, log.infos[0], "using CF instance certificate with subject 'CN=identity-test-client")
+	assert.Empty(t, log.warnings)
+
+	err := CheckRotatedCertificate(log, "CF instance", []byte(testdata.IdentityCert), []byte(testdata.LoginKey))
+	assert.ErrorContains(t, err, "invalid CF instance certificate: private key does not belong to the certificate")
+}
+
+func reverseChain(chain string) string {
+	certs := strings.SplitAfter(chain, "-----END CERTIFICATE-----\n")
+	return certs[1] + certs[0]
+}
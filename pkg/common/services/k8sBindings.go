@@ -0,0 +1,222 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	ServiceBindingRootEnv = "SERVICE_BINDING_ROOT"
+	// SecretMountRoot is where the SAP BTP service operator mounts the binding secrets by default.
+	SecretMountRoot = "/etc/secrets/sapbtp"
+	metadataFile    = ".metadata"
+)
+
+// bindingMetadata is the content of the .metadata file of a binding secret created by the SAP BTP service operator.
+type bindingMetadata struct {
+	MetaDataProperties   []bindingProperty `json:"metaDataProperties"`
+	CredentialProperties []bindingProperty `json:"credentialProperties"`
+}
+
+type bindingProperty struct {
+	Name   string `json:"name"`
+	Format string `json:"format"`
+}
+
+// servicebinding.io metadata files that are not part of the credentials
+var specMetadataFiles = []string{"type", "provider"}
+
+// bindingRoot returns the directory that contains the mounted service bindings, if there is one.
+func bindingRoot() (string, bool) {
+	if root := os.Getenv(ServiceBindingRootEnv); root != "" {
+		return root, true
+	}
+	if isDir(SecretMountRoot) {
+		return SecretMountRoot, true
+	}
+	return "", false
+}
+
+// loadMountedServices reads the bindings of the service type serviceName below root. Two layouts are supported:
+// the servicebinding.io layout <root>/<binding>/ with a file 'type', and the SAP BTP service operator layout
+// <root>/<service type>/<binding>/. Each credential is stored in a file named like its key. If the binding contains
+// a .metadata file, it defines which files are metadata and which credentials are JSON, otherwise files with a JSON
+// object or array are taken as JSON and all others as text.
+func loadMountedServices(log Logger, root, serviceName string) ([]Service, error) {
+	entries, err := readBindingDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("could not read service bindings from %s: %w", root, err)
+	}
+	var result []Service
+	for _, name := range entries {
+		dir := filepath.Join(root, name)
+		if typ, err := os.ReadFile(filepath.Join(dir, "type")); err == nil {
+			if trimValue(typ) != serviceName {
+				continue
+			}
+			svc, err := readMountedService(dir, name)
+			if err != nil {
+				return nil, err
+			}
+			log.Info("Detected '%s' service binding '%s' in %s", serviceName, svc.Name, dir)
+			result = append(result, svc)
+		} else if name == serviceName {
+			bindings, err := readBindingDir(dir)
+			if err != nil {
+				return nil, fmt.Errorf("could not read service bindings from %s: %w", dir, err)
+			}
+			for _, binding := range bindings {
+				svc, err := readMountedService(filepath.Join(dir, binding), binding)
+				if err != nil {
+					return nil, err
+				}
+				log.Info("Detected '%s' service binding '%s' in %s", serviceName, svc.Name, filepath.Join(dir, binding))
+				result = append(result, svc)
+			}
+		}
+	}
+	return result, nil
+}
+
+// readBindingDir returns the sorted names of the subdirectories of dir, without the hidden ones like the '..data'
+// directories of Kubernetes secret volumes.
+func readBindingDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if isDir(filepath.Join(dir, e.Name())) {
+			result = append(result, e.Name())
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func readMountedService(dir, name string) (Service, error) {
+	values, err := readBindingFiles(dir)
+	if err != nil {
+		return Service{}, fmt.Errorf("could not read service binding %s: %w", dir, err)
+	}
+	svc := Service{Name: name, InstanceName: name}
+	credentials := make(map[string]json.RawMessage)
+
+	var metadata bindingMetadata
+	if raw, ok := values[metadataFile]; ok {
+		if err := json.Unmarshal(raw, &metadata); err != nil {
+			return Service{}, fmt.Errorf("invalid %s of service binding %s: %w", metadataFile, dir, err)
+		}
+		for _, p := range metadata.MetaDataProperties {
+			if err := svc.setMetadata(p, values[p.Name]); err != nil {
+				return Service{}, fmt.Errorf("invalid metadata '%s' of service binding %s: %w", p.Name, dir, err)
+			}
+		}
+		for _, p := range metadata.CredentialProperties {
+			if raw, ok := values[p.Name]; ok {
+				if credentials[p.Name], err = propertyValue(p.Format, raw); err != nil {
+					return Service{}, fmt.Errorf("invalid credential '%s' of service binding %s: %w", p.Name, dir, err)
+				}
+			}
+		}
+	} else {
+		for key, raw := range values {
+			if slices.Contains(specMetadataFiles, key) {
+				continue
+			}
+			credentials[key] = guessValue(raw)
+		}
+	}
+	if svc.Credentials, err = json.Marshal(credentials); err != nil {
+		return Service{}, err
+	}
+	return svc, nil
+}
+
+func (svc *Service) setMetadata(p bindingProperty, raw []byte) error {
+	if raw == nil {
+		return nil
+	}
+	switch p.Name {
+	case "instance_name":
+		svc.Name = trimValue(raw)
+		svc.InstanceName = trimValue(raw)
+	case "instance_guid":
+		svc.InstanceID = trimValue(raw)
+	case "tags":
+		if p.Format != "json" {
+			svc.Tags = strings.Split(trimValue(raw), ",")
+			return nil
+		}
+		return json.Unmarshal(raw, &svc.Tags)
+	}
+	return nil
+}
+
+// readBindingFiles returns the content of every file of the binding directory keyed by its name.
+func readBindingFiles(dir string) (map[string][]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(entries))
+	for _, e := range entries {
+		name := filepath.Join(dir, e.Name())
+		if strings.HasPrefix(e.Name(), "..") || isDir(name) {
+			continue
+		}
+		b, err := os.ReadFile(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // dangling symlink
+		} else if err != nil {
+			return nil, err
+		}
+		values[e.Name()] = b
+	}
+	return values, nil
+}
+
+func propertyValue(format string, raw []byte) (json.RawMessage, error) {
+	if format == "json" {
+		if !json.Valid(raw) {
+			return nil, errors.New("no valid JSON")
+		}
+		return raw, nil
+	}
+	return json.Marshal(trimValue(raw))
+}
+
+func guessValue(raw []byte) json.RawMessage {
+	v := strings.TrimSpace(string(raw))
+	if (strings.HasPrefix(v, "{") || strings.HasPrefix(v, "[")) && json.Valid([]byte(v)) {
+		return json.RawMessage(v)
+	}
+	b, _ := json.Marshal(trimValue(raw))
+	return b
+}
+
+// trimValue removes the line break that tools like kubectl often add to the end of a single line value. Multi-line
+// values like PEM encoded certificates are returned unchanged.
+func trimValue(raw []byte) string {
+	v := strings.TrimRight(string(raw), "\r\n")
+	if strings.Contains(v, "\n") {
+		return string(raw)
+	}
+	return v
+}
+
+func isDir(name string) bool {
+	fi, err := os.Stat(name)
+	return err == nil && fi.IsDir()
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SAP/cloud-authorization-buildpack/resources/testdata"
+)
+
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Info(format string, args ...interface{})    { l.t.Logf(format, args...) }
+func (l testLogger) Warning(format string, args ...interface{}) { l.t.Logf(format, args...) }
+func (l testLogger) Error(format string, args ...interface{})   { l.t.Logf(format, args...) }
+
+func TestLoadServiceCredentialsFromMountedBindings(t *testing.T) {
+	tests := []struct {
+		name  string
+		root  string
+		want  IASCredentials
+		check func(t *testing.T, svc *Service)
+	}{
+		{name: "SAP BTP service operator", root: testdata.K8sBindingRoot("sapbtp"), want: IASCredentials{
+			Certificate:         testdata.IdentityCert,
+			ClientID:            "601AED1D-0063-4B5B-8FCE-06FC75AF957C",
+			Domain:              "accounts400.ondemand.com",
+			Domains:             []string{"accounts400.ondemand.com"},
+			Key:                 testdata.IdentityKey,
+			URL:                 "https://mytenant.accounts400.ondemand.com",
+			ZoneUUID:            "3276660F-1C15-4311-9A29-CE8704006361",
+			AmsInstanceID:       "00000000-3b4d-4c41-9e5b-9aee7bfa6348",
+			AmsClientID:         "205459a0-ad5d-4ac7-90e3-d058a53f7485",
+			AmsBundleGatewayURL: "https://mytenant.accounts400.ondemand.com/sap/ams/v1/bundles",
+			AmsServerURL:        "https://mytenant.accounts400.ondemand.com",
+		}, check: func(t *testing.T, svc *Service) {
+			assert.Equal(t, "ias-ams-node", svc.Name)
+			assert.Equal(t, "623D51BC-F961-4D6E-B737-0FC08B495755", svc.InstanceID)
+			assert.Equal(t, []string{"ams"}, svc.Tags)
+			assert.NotContains(t, string(svc.Credentials), "instance_name")
+		}},
+		{name: "servicebinding.io", root: testdata.K8sBindingRoot("servicebinding"), want: IASCredentials{
+			Certificate:         readBindingFile(t, "certificate"),
+			Domains:             []string{"accounts400.ondemand.com"},
+			Key:                 readBindingFile(t, "key"),
+			URL:                 "https://othertenant.accounts400.ondemand.com",
+			AmsInstanceID:       "22222222-3b4d-4c41-9e5b-9aee7bfa6348",
+			AmsBundleGatewayURL: "https://othertenant.accounts400.ondemand.com/sap/ams/v1/bundles",
+			AmsServerURL:        "https://othertenant.accounts400.ondemand.com",
+			AmsValueHelpCertSubject: &DistinguishedName{
+				Country:            []string{"DE"},
+				Organization:       []string{"SAP SE"},
+				OrganizationalUnit: []string{"SAP Cloud Platform Clients", "Canary", "someuid"},
+				Locality:           []string{"AMS"},
+				CommonName:         "ValueHelpmTLSCert",
+			},
+		}, check: func(t *testing.T, svc *Service) {
+			assert.Equal(t, "my-identity", svc.Name)
+			assert.NotContains(t, string(svc.Credentials), "provider")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("VCAP_SERVICES", "")
+			t.Setenv(ServiceBindingRootEnv, tt.root)
+
+			creds, err := LoadServiceCredentials(testLogger{t}, "")
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, *creds)
+
+			candidates, err := mountedCandidates(testLogger{t}, tt.root, "identity")
+			require.NoError(t, err)
+			require.Len(t, candidates, 1)
+			tt.check(t, &candidates[0].Service)
+		})
+	}
+}
+
+func TestLoadMountedServicesSkipsSecretVolumeInternals(t *testing.T) {
+	root := t.TempDir()
+	binding := filepath.Join(root, "identity", "my-ias")
+	data := filepath.Join(binding, "..2024_08_01_12_00_00.123456789")
+	require.NoError(t, os.MkdirAll(data, 0755))
+	require.NoError(t, os.Symlink(filepath.Base(data), filepath.Join(binding, "..data")))
+	for key, value := range map[string]string{"certificate": "cert\n", "authorization_instance_id": "instance-id\n"} {
+		require.NoError(t, os.WriteFile(filepath.Join(data, key), []byte(value), 0600))
+		require.NoError(t, os.Symlink(filepath.Join("..data", key), filepath.Join(binding, key)))
+	}
+	require.NoError(t, os.Symlink("..data/missing", filepath.Join(binding, "dangling")))
+
+	svcs, err := loadMountedServices(testLogger{t}, root, "identity")
+	require.NoError(t, err)
+	require.Len(t, svcs, 1)
+	assert.Equal(t, "my-ias", svcs[0].Name)
+	assert.JSONEq(t, `{"certificate":"cert","authorization_instance_id":"instance-id"}`, string(svcs[0].Credentials))
+}
+
+func readBindingFile(t *testing.T, key string) string {
+	b, err := os.ReadFile(filepath.Join(testdata.K8sBindingRoot("servicebinding"), "my-identity", key))
+	require.NoError(t, err)
+	return string(b)
+}
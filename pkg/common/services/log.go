@@ -2,5 +2,6 @@ package services
 
 type Logger interface {
 	Info(format string, args ...interface{})
+	Warning(format string, args ...interface{})
 	Error(format string, args ...interface{})
 }
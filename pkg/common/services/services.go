@@ -5,7 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"time"
+	"slices"
+	"strings"
 )
 
 const (
@@ -19,85 +20,195 @@ var (
 )
 
 type Service struct {
-	Name        string          `json:"name"`
-	Tags        []string        `json:"tags"`
-	Credentials json.RawMessage `json:"credentials"`
-	InstanceID  string          `json:"instance_guid"`
+	Name         string          `json:"name"`
+	InstanceName string          `json:"instance_name"`
+	Tags         []string        `json:"tags"`
+	Credentials  json.RawMessage `json:"credentials"`
+	InstanceID   string          `json:"instance_guid"`
 }
 
 type IASCredentials struct {
-	Certificate          string    `json:"certificate" validate:"required"`
-	CertificateExpiresAt time.Time `json:"certificate_expires_at"`
-	ClientID             string    `json:"clientid"`
-	Domain               string    `json:"domain"`
-	Domains              []string  `json:"domains"`
-	Key                  string    `json:"key" validate:"required"`
-	OsbURL               string    `json:"osb_url"`
-	ProoftokenURL        string    `json:"prooftoken_url"`
-	URL                  string    `json:"url"`
-	ZoneUUID             string    `json:"zone_uuid"`
+	Certificate   string   `json:"certificate" validate:"required_without=ClientSecret"`
+	ClientID      string   `json:"clientid" validate:"required_with=ClientSecret"`
+	ClientSecret  string   `json:"clientsecret"`
+	Domain        string   `json:"domain"`
+	Domains       []string `json:"domains"`
+	Key           string   `json:"key" validate:"required_with=Certificate"`
+	OsbURL        string   `json:"osb_url"`
+	ProoftokenURL string   `json:"prooftoken_url"`
+	URL           string   `json:"url"`
+	ZoneUUID      string   `json:"zone_uuid"`
 
 	AmsInstanceID       string `json:"authorization_instance_id"  validate:"required"`
 	AmsClientID         string `json:"authorization_client_id"`
 	AmsBundleGatewayURL string `json:"authorization_bundle_url"`
+	// AmsObjectStore is the S3 bucket that contains the authorization bundles of the instance.
+	AmsObjectStore *ObjectStoreCredentials `json:"authorization_object_store,omitempty"`
+	// AmsValueHelpCertIssuer and AmsValueHelpCertSubject identify the client certificate of AMS value-help callbacks.
+	// They are parsed by identityCredentials, so that an invalid value doesn't fail the credential loading.
+	AmsValueHelpCertIssuer  *DistinguishedName `json:"-"`
+	AmsValueHelpCertSubject *DistinguishedName `json:"-"`
 
 	// derived values
 	AmsServerURL string `json:"-"`
+	// TokenURL is the token endpoint of the identity tenant, only set for bindings with a client secret.
+	TokenURL string `json:"-"`
+}
+
+// UsesClientSecret reports whether the binding authenticates with a client secret instead of a certificate.
+func (c *IASCredentials) UsesClientSecret() bool {
+	return c.Certificate == "" && c.ClientSecret != ""
+}
+
+type ObjectStoreCredentials struct {
+	AccessKeyID     string `json:"access_key_id" validate:"required"`
+	SecretAccessKey string `json:"secret_access_key" validate:"required"`
+	Bucket          string `json:"bucket" validate:"required"`
+	Host            string `json:"host" validate:"required"`
+	Region          string `json:"region" validate:"required"`
+	URI             string `json:"uri"`
+	Username        string `json:"username"`
+}
+
+// BucketURL returns the URL of the bucket. A host without scheme is an AWS endpoint, where the bucket is addressed
+// virtual-hosted style. A host with scheme, like a local S3 compatible store, is addressed path style.
+func (o *ObjectStoreCredentials) BucketURL() string {
+	if strings.Contains(o.Host, "://") {
+		return strings.TrimSuffix(o.Host, "/") + "/" + o.Bucket
+	}
+	return "https://" + o.Bucket + "." + o.Host
 }
 
 type MegacliteCredentials struct {
 	URL string `json:"url"`
 }
 
-func LoadService(log Logger, serviceName string) (*Service, error) {
-	svcsString := os.Getenv("VCAP_SERVICES")
+// VcapServicesFilePathEnv names the file that contains the service bindings, which Cloud Foundry sets instead of
+// VCAP_SERVICES if the bindings are too large for an environment variable.
+const VcapServicesFilePathEnv = "VCAP_SERVICES_FILE_PATH"
+
+func hasVcapServices() bool {
+	return os.Getenv(VcapServicesFilePathEnv) != "" || os.Getenv("VCAP_SERVICES") != ""
+}
+
+// vcapServices returns the service bindings from the file VCAP_SERVICES_FILE_PATH or from VCAP_SERVICES. The file
+// takes precedence, since Cloud Foundry only sets it if the bindings are delivered as file.
+func vcapServices() ([]byte, error) {
+	if name := os.Getenv(VcapServicesFilePathEnv); name != "" {
+		raw, err := os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("could not read VCAP_SERVICES from %s: %w", VcapServicesFilePathEnv, err)
+		}
+		return raw, nil
+	}
+	return []byte(os.Getenv("VCAP_SERVICES")), nil
+}
+
+// IdentityServiceNameEnv selects the identity binding by name, instance name or tag if several are bound.
+const IdentityServiceNameEnv = "AMS_IDENTITY_SERVICE_NAME"
+
+// selectService returns the only candidate, or the one chosen by the selector.
+func selectService(log Logger, serviceName string, selector string, candidates []candidate) (*Service, error) {
+	if len(candidates) < 1 {
+		return nil, ErrServiceNotFound
+	}
+	if selector == "" {
+		if len(candidates) > 1 {
+			return nil, fmt.Errorf("expect only one service (type %s or user-provided) but got %d, set %s to the name, instance name or tag of the service to use:%s",
+				serviceName, len(candidates), IdentityServiceNameEnv, listCandidates(candidates))
+		}
+		return &candidates[0].Service, nil
+	}
+
+	var selected []*Service
+	for i := range candidates {
+		if candidates[i].match(selector) {
+			selected = append(selected, &candidates[i].Service)
+		}
+	}
+	switch len(selected) {
+	case 0:
+		return nil, fmt.Errorf("none of the %d %s service(s) matches %s=%q:%s", len(candidates), serviceName, IdentityServiceNameEnv, selector, listCandidates(candidates))
+	case 1:
+		log.Info("Selected '%s' service '%s' via %s=%q", serviceName, selected[0].Name, IdentityServiceNameEnv, selector)
+		return selected[0], nil
+	default:
+		return nil, fmt.Errorf("%d %s services match %s=%q, expect exactly one:%s", len(selected), serviceName, IdentityServiceNameEnv, selector, listCandidates(candidates))
+	}
+}
+
+func mountedCandidates(log Logger, root, serviceName string) ([]candidate, error) {
+	svcs, err := loadMountedServices(log, root, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	candidates := make([]candidate, 0, len(svcs))
+	for _, svc := range svcs {
+		candidates = append(candidates, candidate{Service: svc, kind: "mounted in " + root})
+	}
+	return candidates, nil
+}
+
+func vcapCandidates(log Logger, serviceName string) ([]candidate, error) {
+	raw, err := vcapServices()
+	if err != nil {
+		return nil, err
+	}
 	var svcs map[string][]Service
-	err := json.Unmarshal([]byte(svcsString), &svcs)
+	err = json.Unmarshal(raw, &svcs)
 	if err != nil {
 		return nil, fmt.Errorf("could not unmarshal VCAP_SERVICES: %w", err)
 	}
 
-	filteredServices := make([]Service, 0, 1)
+	candidates := make([]candidate, 0, 1)
 	if ups, ok := svcs["user-provided"]; ok {
 		for i := range ups {
 			if ups[i].Name == serviceName {
 				log.Info("Detected user-provided '%s' service '%s' via its name", serviceName, ups[i].Name)
-				ups[i].InstanceID = "" // delete since it's the instance id of the user-provided-service, not the actual instance
-				filteredServices = append(filteredServices, ups[i])
+			} else if slices.Contains(ups[i].Tags, serviceName) {
+				log.Info("Detected user-provided '%s' service '%s' via its tag '%s'", serviceName, ups[i].Name, serviceName)
+			} else {
 				continue
 			}
-			for _, t := range ups[i].Tags {
-				if t == serviceName {
-					log.Info("Detected user-provided '%s' service '%s' via its tag '%s'", serviceName, ups[i].Name, t)
-					ups[i].InstanceID = "" // delete since it's the instance id of the user-provided-service, not the actual instance
-					filteredServices = append(filteredServices, ups[i])
-				}
-			}
+			ups[i].InstanceID = "" // delete since it's the instance id of the user-provided-service, not the actual instance
+			candidates = append(candidates, candidate{Service: ups[i], kind: "user-provided"})
 		}
 	}
-	filteredServices = append(filteredServices, svcs[serviceName]...)
-	if len(filteredServices) > 1 {
-		return nil, fmt.Errorf("expect only one service (type %s or user-provided) but got %d", serviceName, len(filteredServices))
-	} else if len(filteredServices) < 1 {
-		return nil, ErrServiceNotFound
+	for _, svc := range svcs[serviceName] {
+		candidates = append(candidates, candidate{Service: svc, kind: "type " + serviceName})
 	}
-	return &filteredServices[0], nil
+	return candidates, nil
 }
 
-func LoadServiceCredentials(log Logger) (*IASCredentials, error) {
-	creds, err := fromIdentity(log)
-	if !errors.Is(err, ErrServiceNotFound) { // if service is not found try to find megaclite
-		return creds, err // return creds or err (one of them is nil)
+type candidate struct {
+	Service
+	kind   string
+	reason string
+}
+
+// match reports whether the service has the name, instance name or tag selector and records the reason.
+func (c *candidate) match(selector string) bool {
+	switch {
+	case c.Name == selector:
+		c.reason = "selected by its name"
+	case c.InstanceName == selector:
+		c.reason = "selected by its instance name"
+	case slices.Contains(c.Tags, selector):
+		c.reason = "selected by its tag"
+	default:
+		c.reason = "neither name, instance name nor tags match"
+		return false
 	}
+	return true
+}
 
-	creds, err = fromMegaclite(log)
-	if err != nil {
-		if errors.Is(err, ErrServiceNotFound) {
-			return nil, errors.New("cannot find authorization-enabled identity service")
+func listCandidates(candidates []candidate) string {
+	var sb strings.Builder
+	for _, c := range candidates {
+		fmt.Fprintf(&sb, "\n  - '%s' (%s, instance name '%s', tags %v)", c.Name, c.kind, c.InstanceName, c.Tags)
+		if c.reason != "" {
+			fmt.Fprintf(&sb, ": %s", c.reason)
 		}
-		return nil, fmt.Errorf("error trying to fallback to megaclite proxy to upload AMS DCLs and download AMS bundles: %w", err)
 	}
-
-	log.Info("using megaclite proxy to upload AMS DCLs and download AMS bundles")
-	return creds, nil
+	return sb.String()
 }
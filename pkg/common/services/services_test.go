@@ -0,0 +1,25 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectStoreBucketURL(t *testing.T) {
+	tests := []struct {
+		name string
+		host string
+		want string
+	}{
+		{name: "AWS endpoint", host: "s3-eu-central-1.amazonaws.com", want: "https://my-bucket.s3-eu-central-1.amazonaws.com"},
+		{name: "host with scheme", host: "http://127.0.0.1:9000", want: "http://127.0.0.1:9000/my-bucket"},
+		{name: "host with trailing slash", host: "https://minio.example.com/", want: "https://minio.example.com/my-bucket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := ObjectStoreCredentials{Bucket: "my-bucket", Host: tt.host}
+			assert.Equal(t, tt.want, store.BucketURL())
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// CredentialSourcesEnv configures the comma separated credential sources that are tried in order.
+	CredentialSourcesEnv = "AMS_CREDENTIAL_SOURCES"
+	// CredentialsFileEnv names a JSON file with the credentials of an identity binding.
+	CredentialsFileEnv = "AMS_CREDENTIALS_FILE"
+)
+
+// DefaultCredentialSources is the order of the credential sources if AMS_CREDENTIAL_SOURCES is not set. The file comes
+// first, because it is only used if AMS_CREDENTIALS_FILE is set explicitly.
+var DefaultCredentialSources = []string{"file", "identity", "kubernetes", "megaclite"}
+
+// CredentialSource provides the AMS credentials from one kind of service binding.
+type CredentialSource interface {
+	// Name identifies the source in AMS_CREDENTIAL_SOURCES and in the CredentialReport.
+	Name() string
+	// Load returns the credentials, or an error matching ErrServiceNotFound if the source provides none.
+	Load(log Logger) (*IASCredentials, error)
+}
+
+// skipError is returned by a CredentialSource that provides no credentials, to report why it was skipped.
+type skipError struct{ reason string }
+
+func skip(format string, args ...interface{}) error {
+	return skipError{reason: fmt.Sprintf(format, args...)}
+}
+
+func (e skipError) Error() string { return ErrServiceNotFound.Error() + ": " + e.reason }
+func (e skipError) Unwrap() error { return ErrServiceNotFound }
+
+// CFIdentitySource reads the identity binding from VCAP_SERVICES or VCAP_SERVICES_FILE_PATH.
+type CFIdentitySource struct{ AppRoot string }
+
+func (CFIdentitySource) Name() string { return "identity" }
+
+func (s CFIdentitySource) Load(log Logger) (*IASCredentials, error) {
+	if !hasVcapServices() {
+		return nil, skip("neither VCAP_SERVICES nor %s is set", VcapServicesFilePathEnv)
+	}
+	candidates, err := vcapCandidates(log, "identity")
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, skip("VCAP_SERVICES contains no identity service")
+	}
+	svc, err := selectService(log, "identity", os.Getenv(IdentityServiceNameEnv), candidates)
+	if err != nil {
+		return nil, err
+	}
+	return identityCredentials(log, svc.Credentials, s.AppRoot)
+}
+
+// KubernetesSource reads the identity binding from the secrets mounted below SERVICE_BINDING_ROOT.
+type KubernetesSource struct{ AppRoot string }
+
+func (KubernetesSource) Name() string { return "kubernetes" }
+
+func (s KubernetesSource) Load(log Logger) (*IASCredentials, error) {
+	root, ok := bindingRoot()
+	if !ok {
+		return nil, skip("%s is not set and %s does not exist", ServiceBindingRootEnv, SecretMountRoot)
+	}
+	candidates, err := mountedCandidates(log, root, "identity")
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, skip("no identity service binding is mounted in %s", root)
+	}
+	svc, err := selectService(log, "identity", os.Getenv(IdentityServiceNameEnv), candidates)
+	if err != nil {
+		return nil, err
+	}
+	return identityCredentials(log, svc.Credentials, s.AppRoot)
+}
+
+// FileSource reads the credentials of an identity binding from the JSON file AMS_CREDENTIALS_FILE. Relative paths are
+// resolved against AppRoot.
+type FileSource struct{ AppRoot string }
+
+func (FileSource) Name() string { return "file" }
+
+func (s FileSource) Load(log Logger) (*IASCredentials, error) {
+	name := os.Getenv(CredentialsFileEnv)
+	if name == "" {
+		return nil, skip("%s is not set", CredentialsFileEnv)
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(s.AppRoot, name)
+	}
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the credentials from %s: %w", CredentialsFileEnv, err)
+	}
+	log.Info("Detected identity credentials in %s '%s'", CredentialsFileEnv, name)
+	return identityCredentials(log, raw, s.AppRoot)
+}
+
+// MegacliteSource uses the megaclite proxy of DwC, which is bound as user-provided service.
+type MegacliteSource struct{}
+
+func (MegacliteSource) Name() string { return "megaclite" }
+
+func (MegacliteSource) Load(log Logger) (*IASCredentials, error) {
+	if !hasVcapServices() {
+		return nil, skip("neither VCAP_SERVICES nor %s is set", VcapServicesFilePathEnv)
+	}
+	candidates, err := vcapCandidates(log, "megaclite")
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, skip("VCAP_SERVICES contains no megaclite service")
+	}
+	svc, err := selectService(log, "megaclite", "", candidates)
+	if err != nil {
+		return nil, fmt.Errorf("error trying to use megaclite proxy to upload AMS DCLs and download AMS bundles: %w", err)
+	}
+	creds, err := megacliteCredentials(svc.Credentials)
+	if err != nil {
+		return nil, fmt.Errorf("error trying to use megaclite proxy to upload AMS DCLs and download AMS bundles: %w", err)
+	}
+	log.Info("using megaclite proxy to upload AMS DCLs and download AMS bundles")
+	return creds, nil
+}
+
+// SourceStatus is the result of trying a CredentialSource.
+type SourceStatus string
+
+const (
+	SourceUsed    SourceStatus = "used"
+	SourceSkipped SourceStatus = "skipped"
+	SourceFailed  SourceStatus = "failed"
+)
+
+// SourceAttempt records the result of trying a CredentialSource and the reason why it was skipped or failed.
+type SourceAttempt struct {
+	Source string
+	Status SourceStatus
+	Reason string
+}
+
+// CredentialReport lists the credential sources that were tried, in order.
+type CredentialReport []SourceAttempt
+
+func (r CredentialReport) String() string {
+	var sb strings.Builder
+	for _, a := range r {
+		fmt.Fprintf(&sb, "\n  - %s: %s", a.Source, a.Status)
+		if a.Reason != "" {
+			fmt.Fprintf(&sb, " (%s)", a.Reason)
+		}
+	}
+	return sb.String()
+}
+
+// CredentialChain tries its credential sources in order and uses the first one that provides credentials.
+type CredentialChain []CredentialSource
+
+// NewCredentialChain returns the chain configured by AMS_CREDENTIAL_SOURCES or DefaultCredentialSources. Files
+// referenced by the configuration, like AMS_CREDENTIALS_FILE, are resolved against appRoot.
+func NewCredentialChain(appRoot string) (CredentialChain, error) {
+	sources := map[string]CredentialSource{}
+	for _, src := range []CredentialSource{
+		FileSource{AppRoot: appRoot},
+		CFIdentitySource{AppRoot: appRoot},
+		KubernetesSource{AppRoot: appRoot},
+		MegacliteSource{},
+	} {
+		sources[src.Name()] = src
+	}
+
+	names := DefaultCredentialSources
+	if v := os.Getenv(CredentialSourcesEnv); v != "" {
+		names = nil
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	chain := make(CredentialChain, 0, len(names))
+	for _, name := range names {
+		src, ok := sources[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown credential source %q in %s, supported are %s", name, CredentialSourcesEnv, strings.Join(DefaultCredentialSources, ", "))
+		}
+		if slices.ContainsFunc(chain, func(s CredentialSource) bool { return s.Name() == name }) {
+			return nil, fmt.Errorf("credential source %q is listed more than once in %s", name, CredentialSourcesEnv)
+		}
+		chain = append(chain, src)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%s contains no credential source", CredentialSourcesEnv)
+	}
+	return chain, nil
+}
+
+// Load returns the credentials of the first source that provides them. A source that fails stops the chain, since
+// falling back to another binding would hide the misconfiguration.
+func (c CredentialChain) Load(log Logger) (*IASCredentials, CredentialReport, error) {
+	var report CredentialReport
+	for _, src := range c {
+		creds, err := src.Load(log)
+		var skipped skipError
+		switch {
+		case errors.As(err, &skipped):
+			report = append(report, SourceAttempt{Source: src.Name(), Status: SourceSkipped, Reason: skipped.reason})
+		case errors.Is(err, ErrServiceNotFound):
+			report = append(report, SourceAttempt{Source: src.Name(), Status: SourceSkipped, Reason: err.Error()})
+		case err != nil:
+			report = append(report, SourceAttempt{Source: src.Name(), Status: SourceFailed, Reason: err.Error()})
+			return nil, report, err
+		default:
+			report = append(report, SourceAttempt{Source: src.Name(), Status: SourceUsed})
+			return creds, report, nil
+		}
+	}
+	return nil, report, fmt.Errorf("cannot find authorization-enabled identity service, tried the credential sources:%s", report)
+}
+
+// LoadServiceCredentials returns the credentials of the first source of the chain configured by AMS_CREDENTIAL_SOURCES
+// that provides them. Files referenced by the configuration, like AMS_IDENTITY_KEY_FILE, are resolved against appRoot.
+func LoadServiceCredentials(log Logger, appRoot string) (*IASCredentials, error) {
+	chain, err := NewCredentialChain(appRoot)
+	if err != nil {
+		return nil, err
+	}
+	creds, report, err := chain.Load(log)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Loaded AMS credentials from credential source '%s', tried:%s", report[len(report)-1].Source, report)
+	return creds, nil
+}
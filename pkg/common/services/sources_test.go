@@ -0,0 +1,138 @@
+package services
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SAP/cloud-authorization-buildpack/resources/testdata"
+)
+
+func TestCredentialChain(t *testing.T) {
+	appRoot := t.TempDir()
+	credentialsFile := filepath.Join(appRoot, "ams-credentials.json")
+	require.NoError(t, os.WriteFile(credentialsFile, identityCredentialsJSON(t, testdata.EnvWithMultipleIAS, "ias-login-binding"), 0600))
+
+	tests := []struct {
+		name         string
+		vcapServices string
+		env          map[string]string
+		wantInstance string
+		wantReport   CredentialReport
+		wantErr      string
+	}{
+		{name: "identity by default", vcapServices: testdata.EnvWithIASAuthX509, wantInstance: "00000000-3b4d-4c41-9e5b-9aee7bfa6348",
+			wantReport: CredentialReport{
+				{Source: "file", Status: SourceSkipped, Reason: "AMS_CREDENTIALS_FILE is not set"},
+				{Source: "identity", Status: SourceUsed},
+			}},
+		{name: "megaclite as fallback", vcapServices: testdata.EnvWithMegaclite, wantInstance: MegacliteID,
+			wantReport: CredentialReport{
+				{Source: "file", Status: SourceSkipped, Reason: "AMS_CREDENTIALS_FILE is not set"},
+				{Source: "identity", Status: SourceSkipped, Reason: "VCAP_SERVICES contains no identity service"},
+				{Source: "kubernetes", Status: SourceSkipped, Reason: "SERVICE_BINDING_ROOT is not set and /etc/secrets/sapbtp does not exist"},
+				{Source: "megaclite", Status: SourceUsed},
+			}},
+		{name: "credentials file takes precedence", vcapServices: testdata.EnvWithIASAuthX509, env: map[string]string{CredentialsFileEnv: credentialsFile},
+			wantInstance: "11111111-3b4d-4c41-9e5b-9aee7bfa6348",
+			wantReport:   CredentialReport{{Source: "file", Status: SourceUsed}}},
+		{name: "relative credentials file", env: map[string]string{CredentialsFileEnv: "ams-credentials.json"},
+			wantInstance: "11111111-3b4d-4c41-9e5b-9aee7bfa6348",
+			wantReport:   CredentialReport{{Source: "file", Status: SourceUsed}}},
+		{name: "missing credentials file", vcapServices: testdata.EnvWithIASAuthX509, env: map[string]string{CredentialsFileEnv: "missing.json"},
+			wantErr: "could not read the credentials from AMS_CREDENTIALS_FILE",
+			wantReport: CredentialReport{{Source: "file", Status: SourceFailed,
+				Reason: "could not read the credentials from AMS_CREDENTIALS_FILE: open " + filepath.Join(appRoot, "missing.json") + ": no such file or directory"}}},
+		{name: "configured order", vcapServices: testdata.EnvWithMegacliteAndIAS, env: map[string]string{CredentialSourcesEnv: "megaclite, identity"},
+			wantInstance: MegacliteID,
+			wantReport:   CredentialReport{{Source: "megaclite", Status: SourceUsed}}},
+		{name: "kubernetes mounts", env: map[string]string{CredentialSourcesEnv: "kubernetes", ServiceBindingRootEnv: testdata.K8sBindingRoot("sapbtp")},
+			wantInstance: "00000000-3b4d-4c41-9e5b-9aee7bfa6348",
+			wantReport:   CredentialReport{{Source: "kubernetes", Status: SourceUsed}}},
+		{name: "failing source stops the chain", vcapServices: testdata.EnvWithIASAuthX509Expired, env: map[string]string{CredentialSourcesEnv: "identity,megaclite"},
+			wantErr: "certificate has expired"},
+		{name: "no source provides credentials", env: map[string]string{CredentialSourcesEnv: "identity,megaclite"},
+			wantErr: "cannot find authorization-enabled identity service, tried the credential sources:\n  - identity: skipped (neither VCAP_SERVICES nor VCAP_SERVICES_FILE_PATH is set)\n  - megaclite: skipped (neither VCAP_SERVICES nor VCAP_SERVICES_FILE_PATH is set)"},
+		{name: "unknown source", env: map[string]string{CredentialSourcesEnv: "identity,vault"},
+			wantErr: `unknown credential source "vault" in AMS_CREDENTIAL_SOURCES, supported are file, identity, kubernetes, megaclite`},
+		{name: "duplicate source", env: map[string]string{CredentialSourcesEnv: "identity,identity"},
+			wantErr: `credential source "identity" is listed more than once in AMS_CREDENTIAL_SOURCES`},
+		{name: "empty source list", env: map[string]string{CredentialSourcesEnv: " , "},
+			wantErr: "AMS_CREDENTIAL_SOURCES contains no credential source"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("VCAP_SERVICES", tt.vcapServices)
+			for _, key := range []string{CredentialSourcesEnv, CredentialsFileEnv, ServiceBindingRootEnv} {
+				t.Setenv(key, tt.env[key])
+			}
+
+			chain, err := NewCredentialChain(appRoot)
+			if err != nil {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			creds, report, err := chain.Load(testLogger{t})
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.wantInstance, creds.AmsInstanceID)
+			}
+			if tt.wantReport != nil {
+				assert.Equal(t, tt.wantReport, report)
+			}
+		})
+	}
+}
+
+// identityCredentialsJSON returns the credentials of the named identity binding of the VCAP_SERVICES fixture.
+func identityCredentialsJSON(t *testing.T, vcapServices, name string) []byte {
+	var svcs map[string][]Service
+	require.NoError(t, json.Unmarshal([]byte(vcapServices), &svcs))
+	for _, svc := range svcs["identity"] {
+		if svc.Name == name {
+			return svc.Credentials
+		}
+	}
+	t.Fatalf("no identity binding %s", name)
+	return nil
+}
+
+func TestLoadServiceCredentialsFromVcapServicesFile(t *testing.T) {
+	dir := t.TempDir()
+	vcapFile := filepath.Join(dir, "vcap_services.json")
+	require.NoError(t, os.WriteFile(vcapFile, []byte(testdata.EnvWithIASAuthX509), 0600))
+
+	tests := []struct {
+		name         string
+		vcapServices string
+		vcapFile     string
+		wantInstance string
+		wantErr      string
+	}{
+		{name: "env only", vcapServices: testdata.EnvWithMegaclite, wantInstance: MegacliteID},
+		{name: "file only", vcapFile: vcapFile, wantInstance: "00000000-3b4d-4c41-9e5b-9aee7bfa6348"},
+		{name: "file takes precedence", vcapServices: testdata.EnvWithMegaclite, vcapFile: vcapFile, wantInstance: "00000000-3b4d-4c41-9e5b-9aee7bfa6348"},
+		{name: "missing file", vcapServices: testdata.EnvWithIASAuthX509, vcapFile: filepath.Join(dir, "missing.json"),
+			wantErr: "could not read VCAP_SERVICES from VCAP_SERVICES_FILE_PATH"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("VCAP_SERVICES", tt.vcapServices)
+			t.Setenv(VcapServicesFilePathEnv, tt.vcapFile)
+
+			creds, err := LoadServiceCredentials(testLogger{t}, "")
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantInstance, creds.AmsInstanceID)
+		})
+	}
+}
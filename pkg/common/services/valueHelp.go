@@ -0,0 +1,105 @@
+package services
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// DistinguishedName is the expected issuer or subject of the client certificate of AMS value-help callbacks. The
+// identity broker encodes it as JSON object with the attribute names of pkix.Name, wrapped in a JSON string.
+type DistinguishedName struct {
+	Country            []string `json:"Country,omitempty"`
+	Organization       []string `json:"Organization,omitempty"`
+	OrganizationalUnit []string `json:"OrganizationalUnit,omitempty"`
+	Locality           []string `json:"Locality,omitempty"`
+	Province           []string `json:"Province,omitempty"`
+	StreetAddress      []string `json:"StreetAddress,omitempty"`
+	PostalCode         []string `json:"PostalCode,omitempty"`
+	SerialNumber       string   `json:"SerialNumber,omitempty"`
+	CommonName         string   `json:"CommonName,omitempty"`
+}
+
+// UnmarshalJSON accepts the JSON object as string, like in VCAP_SERVICES, or as object, like in mounted bindings.
+func (n *DistinguishedName) UnmarshalJSON(data []byte) error {
+	type plain DistinguishedName
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		data = []byte(s)
+	}
+	if err := json.Unmarshal(data, (*plain)(n)); err != nil {
+		return fmt.Errorf("invalid distinguished name: %w", err)
+	}
+	return nil
+}
+
+const (
+	valueHelpCertIssuerKey  = "authorization_value_help_certificate_issuer"
+	valueHelpCertSubjectKey = "authorization_value_help_certificate_subject"
+)
+
+// valueHelpCertificate contains the raw value-help certificate names of an identity binding.
+type valueHelpCertificate struct {
+	Issuer  json.RawMessage `json:"authorization_value_help_certificate_issuer"`
+	Subject json.RawMessage `json:"authorization_value_help_certificate_subject"`
+}
+
+// parseValueHelpName returns nil for an absent or empty name. An invalid name is ignored with a warning, since it only
+// breaks the verification of value-help callbacks and not the authorization of the app.
+func parseValueHelpName(log Logger, key string, raw json.RawMessage) *DistinguishedName {
+	switch string(bytes.TrimSpace(raw)) {
+	case "", "null", `""`:
+		return nil
+	}
+	var dn DistinguishedName
+	if err := json.Unmarshal(raw, &dn); err != nil {
+		log.Warning("ignoring %s of the identity binding, value-help callbacks cannot be verified: %s", key, err)
+		return nil
+	}
+	return &dn
+}
+
+// Name returns the distinguished name as pkix.Name.
+func (n DistinguishedName) Name() pkix.Name {
+	return pkix.Name{
+		Country:            n.Country,
+		Organization:       n.Organization,
+		OrganizationalUnit: n.OrganizationalUnit,
+		Locality:           n.Locality,
+		Province:           n.Province,
+		StreetAddress:      n.StreetAddress,
+		PostalCode:         n.PostalCode,
+		SerialNumber:       n.SerialNumber,
+		CommonName:         n.CommonName,
+	}
+}
+
+func (n DistinguishedName) String() string {
+	return n.Name().String()
+}
+
+// Matches reports whether name has exactly the attributes of the distinguished name. The order of the values of an
+// attribute is ignored.
+func (n DistinguishedName) Matches(name pkix.Name) bool {
+	return n.SerialNumber == name.SerialNumber &&
+		n.CommonName == name.CommonName &&
+		sameValues(n.Country, name.Country) &&
+		sameValues(n.Organization, name.Organization) &&
+		sameValues(n.OrganizationalUnit, name.OrganizationalUnit) &&
+		sameValues(n.Locality, name.Locality) &&
+		sameValues(n.Province, name.Province) &&
+		sameValues(n.StreetAddress, name.StreetAddress) &&
+		sameValues(n.PostalCode, name.PostalCode)
+}
+
+func sameValues(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"crypto/x509/pkix"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SAP/cloud-authorization-buildpack/resources/testdata"
+)
+
+func TestDistinguishedNameUnmarshalJSON(t *testing.T) {
+	want := DistinguishedName{Country: []string{"DE"}, Organization: []string{"SAP SE"}, CommonName: "SAP Cloud Root CA"}
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{name: "JSON string", json: `"{\"Country\":[\"DE\"],\"Organization\":[\"SAP SE\"],\"CommonName\":\"SAP Cloud Root CA\"}"`},
+		{name: "JSON object", json: `{"Country":["DE"],"Organization":["SAP SE"],"CommonName":"SAP Cloud Root CA"}`},
+		{name: "string without JSON", json: `"CN=SAP Cloud Root CA"`, wantErr: "invalid distinguished name"},
+		{name: "wrong attribute type", json: `{"CommonName":["SAP Cloud Root CA"]}`, wantErr: "invalid distinguished name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dn DistinguishedName
+			err := json.Unmarshal([]byte(tt.json), &dn)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, want, dn)
+		})
+	}
+}
+
+func TestDistinguishedNameMatches(t *testing.T) {
+	dn := DistinguishedName{Country: []string{"DE"}, OrganizationalUnit: []string{"Clients", "Canary"}, CommonName: "ValueHelpmTLSCert"}
+	tests := []struct {
+		name string
+		pkix pkix.Name
+		want bool
+	}{
+		{name: "same attributes", pkix: pkix.Name{Country: []string{"DE"}, OrganizationalUnit: []string{"Clients", "Canary"}, CommonName: "ValueHelpmTLSCert"}, want: true},
+		{name: "different order of values", pkix: pkix.Name{Country: []string{"DE"}, OrganizationalUnit: []string{"Canary", "Clients"}, CommonName: "ValueHelpmTLSCert"}, want: true},
+		{name: "different common name", pkix: pkix.Name{Country: []string{"DE"}, OrganizationalUnit: []string{"Clients", "Canary"}, CommonName: "Other"}},
+		{name: "missing value", pkix: pkix.Name{Country: []string{"DE"}, OrganizationalUnit: []string{"Clients"}, CommonName: "ValueHelpmTLSCert"}},
+		{name: "additional attribute", pkix: pkix.Name{Country: []string{"DE"}, Locality: []string{"AMS"}, OrganizationalUnit: []string{"Clients", "Canary"}, CommonName: "ValueHelpmTLSCert"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, dn.Matches(tt.pkix))
+		})
+	}
+}
+
+func TestLoadValueHelpCertificate(t *testing.T) {
+	t.Setenv("VCAP_SERVICES", testdata.EnvWithIASAuthX509)
+
+	creds, err := LoadServiceCredentials(testLogger{t}, "")
+	require.NoError(t, err)
+	require.NotNil(t, creds.AmsValueHelpCertIssuer)
+	require.NotNil(t, creds.AmsValueHelpCertSubject)
+	assert.Equal(t, "CN=SAP Cloud Root CA,O=SAP SE,L=Walldorf,C=DE", creds.AmsValueHelpCertIssuer.String())
+	assert.Equal(t, "CN=ValueHelpmTLSCert,OU=SAP Cloud Platform Clients+OU=Canary+OU=someuid,O=SAP SE,L=AMS,C=DE", creds.AmsValueHelpCertSubject.String())
+}
+
+func TestLoadValueHelpCertificateLeniently(t *testing.T) {
+	issuer := `"authorization_value_help_certificate_issuer": "{\"Country\":[\"DE\"],\"Organization\":[\"SAP SE\"],\"Locality\":[\"Walldorf\"],\"CommonName\":\"SAP Cloud Root CA\"}"`
+	require.Contains(t, testdata.EnvWithIASAuthX509, issuer)
+	tests := []struct {
+		name        string
+		issuer      string
+		wantWarning string
+	}{
+		{name: "empty string", issuer: `""`},
+		{name: "null", issuer: `null`},
+		{name: "string without JSON", issuer: `"CN=SAP Cloud Root CA"`,
+			wantWarning: "ignoring authorization_value_help_certificate_issuer of the identity binding, value-help callbacks cannot be verified: invalid distinguished name"},
+		{name: "wrong attribute type", issuer: `{"CommonName":["SAP Cloud Root CA"]}`,
+			wantWarning: "ignoring authorization_value_help_certificate_issuer of the identity binding, value-help callbacks cannot be verified: invalid distinguished name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("VCAP_SERVICES", strings.Replace(testdata.EnvWithIASAuthX509, issuer, `"authorization_value_help_certificate_issuer": `+tt.issuer, 1))
+			log := &recordingLogger{}
+
+			creds, err := LoadServiceCredentials(log, "")
+			require.NoError(t, err)
+			assert.Nil(t, creds.AmsValueHelpCertIssuer)
+			assert.NotNil(t, creds.AmsValueHelpCertSubject)
+			if tt.wantWarning == "" {
+				assert.Empty(t, log.warnings)
+				return
+			}
+			require.Len(t, log.warnings, 1)
+			assert.Contains(t, log.warnings[0], tt.wantWarning)
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package dcl
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/SAP/cloud-authorization-buildpack/pkg/uploader"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenPunct
+	tokenIllegal
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokenEOF:
+		return "end of file"
+	case tokenIdent:
+		return "identifier"
+	case tokenString:
+		return "string"
+	case tokenNumber:
+		return "number"
+	case tokenPunct:
+		return "symbol"
+	default:
+		return "illegal token"
+	}
+}
+
+type token struct {
+	kind   tokenKind
+	text   string
+	line   int
+	column int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return t.kind.String()
+	}
+	return fmt.Sprintf("'%s'", t.text)
+}
+
+// is reports whether the token is the given keyword or symbol. Keywords are case-insensitive in DCL.
+func (t token) is(text string) bool {
+	if t.kind == tokenIdent {
+		return strings.EqualFold(t.text, text)
+	}
+	return t.kind == tokenPunct && t.text == text
+}
+
+var multiCharPuncts = []string{"<=", ">=", "<>", "!="}
+
+const singleCharPuncts = "{}()[],;:.=<>*@-+$"
+
+type lexer struct {
+	src    string
+	pos    int
+	line   int
+	column int
+	issues []uploader.Dclssue
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: src, line: 1, column: 1}
+}
+
+func (l *lexer) tokenize() []token {
+	var tokens []token
+	for {
+		t := l.next()
+		tokens = append(tokens, t)
+		if t.kind == tokenEOF {
+			return tokens
+		}
+	}
+}
+
+func (l *lexer) peekRune(offset int) rune {
+	if l.pos+offset >= len(l.src) {
+		return 0
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos+offset:])
+	return r
+}
+
+func (l *lexer) advance() rune {
+	r, size := utf8.DecodeRuneInString(l.src[l.pos:])
+	l.pos += size
+	if r == '\n' {
+		l.line++
+		l.column = 1
+	} else {
+		l.column++
+	}
+	return r
+}
+
+func (l *lexer) errorf(line, column int, format string, args ...interface{}) {
+	l.issues = append(l.issues, newSyntaxError(line, column, format, args...))
+}
+
+func (l *lexer) skipWhitespaceAndComments() {
+	for l.pos < len(l.src) {
+		r := l.peekRune(0)
+		switch {
+		case unicode.IsSpace(r) || r == '\uFEFF':
+			l.advance()
+		case r == '/' && l.peekRune(1) == '/':
+			for l.pos < len(l.src) && l.peekRune(0) != '\n' {
+				l.advance()
+			}
+		case r == '/' && l.peekRune(1) == '*':
+			line, column := l.line, l.column
+			l.advance()
+			l.advance()
+			for {
+				if l.pos >= len(l.src) {
+					l.errorf(line, column, "unterminated block comment")
+					return
+				}
+				if l.peekRune(0) == '*' && l.peekRune(1) == '/' {
+					l.advance()
+					l.advance()
+					break
+				}
+				l.advance()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (l *lexer) next() token {
+	l.skipWhitespaceAndComments()
+	t := token{line: l.line, column: l.column}
+	if l.pos >= len(l.src) {
+		t.kind = tokenEOF
+		return t
+	}
+	start := l.pos
+	r := l.peekRune(0)
+	switch {
+	case isIdentStart(r):
+		for l.pos < len(l.src) && isIdentPart(l.peekRune(0)) {
+			l.advance()
+		}
+		t.kind = tokenIdent
+	case unicode.IsDigit(r):
+		for l.pos < len(l.src) && (unicode.IsDigit(l.peekRune(0)) || l.peekRune(0) == '.' && unicode.IsDigit(l.peekRune(1))) {
+			l.advance()
+		}
+		t.kind = tokenNumber
+	case r == '\'' || r == '"':
+		return l.readString(t, r)
+	default:
+		for _, p := range multiCharPuncts {
+			if strings.HasPrefix(l.src[l.pos:], p) {
+				l.advance()
+				l.advance()
+				t.kind = tokenPunct
+				t.text = p
+				return t
+			}
+		}
+		l.advance()
+		if strings.ContainsRune(singleCharPuncts, r) {
+			t.kind = tokenPunct
+		} else {
+			t.kind = tokenIllegal
+			l.errorf(t.line, t.column, "unexpected character %q", r)
+		}
+	}
+	t.text = l.src[start:l.pos]
+	return t
+}
+
+// readString reads a quoted literal. A quote character is escaped by doubling it, as in SQL.
+func (l *lexer) readString(t token, quote rune) token {
+	l.advance()
+	var sb strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.peekRune(0) == '\n' {
+			l.errorf(t.line, t.column, "unterminated string literal")
+			t.kind = tokenString
+			t.text = sb.String()
+			return t
+		}
+		r := l.advance()
+		if r == quote {
+			if l.peekRune(0) != quote {
+				break
+			}
+			l.advance()
+		}
+		sb.WriteRune(r)
+	}
+	t.kind = tokenString
+	t.text = sb.String()
+	return t
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentPart(r rune) bool {
+	return isIdentStart(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,587 @@
+package dcl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/SAP/cloud-authorization-buildpack/pkg/uploader"
+)
+
+const (
+	SeverityError   = "ERROR"
+	SeverityWarning = "WARNING"
+)
+
+var knownTypes = map[string]bool{"string": true, "number": true, "boolean": true}
+
+// errSyntax aborts the current declaration or rule; the issue itself has already been recorded.
+var errSyntax = errors.New("syntax error")
+
+type parser struct {
+	tokens   []token
+	pos      int
+	issues   []uploader.Dclssue
+	policies map[string]bool
+	schemas  int
+}
+
+// Parse checks a single DCL document against the SCHEMA / POLICY / FUNCTION grammar and returns all issues found.
+// Parsing continues after an error, so one call reports every broken rule of the document.
+func Parse(src []byte) []uploader.Dclssue {
+	l := newLexer(string(src))
+	p := &parser{tokens: l.tokenize(), policies: make(map[string]bool)}
+	p.issues = append(p.issues, l.issues...)
+	p.parseDocument()
+	return p.issues
+}
+
+func newSyntaxError(line, column int, format string, args ...interface{}) uploader.Dclssue {
+	return uploader.Dclssue{
+		Line:        line,
+		Column:      column,
+		Message:     fmt.Sprintf(format, args...),
+		SyntaxError: true,
+		Severity:    SeverityError,
+	}
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) peekN(n int) token {
+	if p.pos+n >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.pos+n]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) accept(text string) bool {
+	if p.peek().is(text) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text, context string) error {
+	if p.accept(text) {
+		return nil
+	}
+	return p.unexpected(fmt.Sprintf("'%s'", text), context)
+}
+
+func (p *parser) expectIdent(what string) (token, error) {
+	t := p.peek()
+	if t.kind != tokenIdent {
+		return t, p.unexpected(what, "")
+	}
+	return p.next(), nil
+}
+
+// expectName accepts an identifier or a quoted name, like POLICY "My Policy".
+func (p *parser) expectName(what string) (token, error) {
+	if t := p.peek(); t.kind == tokenString {
+		return p.next(), nil
+	}
+	return p.expectIdent(what)
+}
+
+func (p *parser) unexpected(expected, context string) error {
+	t := p.peek()
+	msg := fmt.Sprintf("expected %s but found %s", expected, t)
+	if context != "" {
+		msg += " " + context
+	}
+	if t.kind != tokenIllegal { // the lexer already reported illegal characters
+		p.issues = append(p.issues, newSyntaxError(t.line, t.column, "%s", msg))
+	}
+	return errSyntax
+}
+
+func (p *parser) report(t token, severity string, format string, args ...interface{}) {
+	p.issues = append(p.issues, uploader.Dclssue{
+		Line:     t.line,
+		Column:   t.column,
+		Message:  fmt.Sprintf(format, args...),
+		Severity: severity,
+	})
+}
+
+func (p *parser) parseDocument() {
+	for p.peek().kind != tokenEOF {
+		if err := p.parseDeclaration(); err != nil {
+			p.skipToDeclaration()
+		}
+	}
+}
+
+// skipToDeclaration drops tokens until the next token that can start a top level declaration.
+func (p *parser) skipToDeclaration() {
+	p.next()
+	for t := p.peek(); t.kind != tokenEOF; t = p.peek() {
+		if t.is("SCHEMA") || t.is("POLICY") || t.is("INTERNAL") || t.is("DEFAULT") || t.is("FUNCTION") {
+			return
+		}
+		p.next()
+	}
+}
+
+func (p *parser) parseDeclaration() error {
+	if err := p.parseAnnotations(); err != nil {
+		return err
+	}
+	t := p.peek()
+	switch {
+	case t.is("SCHEMA"):
+		return p.parseSchema()
+	case t.is("POLICY") || t.is("INTERNAL") || t.is("DEFAULT"):
+		return p.parsePolicy()
+	case t.is("FUNCTION"):
+		return p.parseFunction()
+	default:
+		return p.unexpected("SCHEMA, POLICY or FUNCTION", "")
+	}
+}
+
+func (p *parser) parseSchema() error {
+	t := p.next()
+	p.schemas++
+	if p.schemas > 1 {
+		p.report(t, SeverityError, "only one SCHEMA may be declared per file")
+	}
+	if err := p.expect("{", "after SCHEMA"); err != nil {
+		return err
+	}
+	if err := p.parseAttributes(); err != nil {
+		return err
+	}
+	p.accept(";")
+	return nil
+}
+
+// parseAttributes parses a comma separated list of schema attributes up to and including the closing brace.
+func (p *parser) parseAttributes() error {
+	names := make(map[string]bool)
+	for !p.accept("}") {
+		if err := p.parseAnnotations(); err != nil {
+			return err
+		}
+		name, err := p.expectIdent("attribute name")
+		if err != nil {
+			return err
+		}
+		if names[strings.ToLower(name.text)] {
+			p.report(name, SeverityError, "duplicate attribute '%s'", name.text)
+		}
+		names[strings.ToLower(name.text)] = true
+		if err := p.expect(":", fmt.Sprintf("after attribute '%s'", name.text)); err != nil {
+			return err
+		}
+		if p.accept("{") {
+			if err := p.parseAttributes(); err != nil {
+				return err
+			}
+		} else if err := p.parseType(); err != nil {
+			return err
+		}
+		if !p.accept(",") && !p.peek().is("}") {
+			return p.unexpected("',' or '}'", "in SCHEMA")
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseType() error {
+	t, err := p.expectIdent("attribute type")
+	if err != nil {
+		return err
+	}
+	if !knownTypes[strings.ToLower(t.text)] {
+		p.report(t, SeverityWarning, "unknown attribute type '%s'", t.text)
+	}
+	if p.accept("[") {
+		return p.expect("]", "in array type")
+	}
+	return nil
+}
+
+func (p *parser) parsePolicy() error {
+	if !p.accept("INTERNAL") {
+		p.accept("DEFAULT")
+	}
+	if err := p.expect("POLICY", ""); err != nil {
+		return err
+	}
+	name, err := p.expectName("policy name")
+	if err != nil {
+		return err
+	}
+	if p.policies[strings.ToLower(name.text)] {
+		p.report(name, SeverityError, "duplicate policy '%s'", name.text)
+	}
+	p.policies[strings.ToLower(name.text)] = true
+	if err := p.expect("{", fmt.Sprintf("after POLICY %s", name.text)); err != nil {
+		return err
+	}
+	for !p.accept("}") {
+		if p.peek().kind == tokenEOF {
+			return p.unexpected("'}'", fmt.Sprintf("to close POLICY %s", name.text))
+		}
+		if err := p.parseRule(); err != nil {
+			if !p.skipToRuleEnd() {
+				return err
+			}
+		}
+	}
+	p.accept(";")
+	return nil
+}
+
+// parseFunction parses a function declaration like FUNCTION isAdmin(user: String) RETURNS Boolean { RETURN ...; }.
+func (p *parser) parseFunction() error {
+	p.next()
+	name, err := p.expectName("function name")
+	if err != nil {
+		return err
+	}
+	if err := p.expect("(", fmt.Sprintf("after FUNCTION %s", name.text)); err != nil {
+		return err
+	}
+	for !p.accept(")") {
+		param, err := p.expectIdent("parameter name")
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":", fmt.Sprintf("after parameter '%s'", param.text)); err != nil {
+			return err
+		}
+		if err := p.parseType(); err != nil {
+			return err
+		}
+		if !p.accept(",") && !p.peek().is(")") {
+			return p.unexpected("',' or ')'", "in parameter list")
+		}
+	}
+	if p.accept("RETURNS") {
+		if err := p.parseType(); err != nil {
+			return err
+		}
+	}
+	if err := p.expect("{", fmt.Sprintf("after FUNCTION %s", name.text)); err != nil {
+		return err
+	}
+	if err := p.expect("RETURN", "in FUNCTION body"); err != nil {
+		return err
+	}
+	if err := p.parseCondition(); err != nil {
+		return err
+	}
+	p.accept(";")
+	if err := p.expect("}", fmt.Sprintf("to close FUNCTION %s", name.text)); err != nil {
+		return err
+	}
+	p.accept(";")
+	return nil
+}
+
+// skipToRuleEnd drops tokens until the end of the current rule. It returns false if the policy body is left.
+func (p *parser) skipToRuleEnd() bool {
+	for t := p.peek(); t.kind != tokenEOF; t = p.peek() {
+		switch {
+		case t.is(";"):
+			p.next()
+			return true
+		case t.is("}"):
+			return true
+		case t.is("POLICY") || t.is("SCHEMA") || t.is("FUNCTION"):
+			return false
+		}
+		p.next()
+	}
+	return false
+}
+
+func (p *parser) parseRule() error {
+	if err := p.parseAnnotations(); err != nil {
+		return err
+	}
+	t := p.peek()
+	var err error
+	switch {
+	case t.is("GRANT"):
+		err = p.parseGrant()
+	case t.is("USE"):
+		err = p.parseUse()
+	default:
+		return p.unexpected("GRANT or USE", "in POLICY body")
+	}
+	if err != nil {
+		return err
+	}
+	return p.expect(";", "at end of rule")
+}
+
+func (p *parser) parseGrant() error {
+	p.next()
+	if err := p.parseNameList("action"); err != nil {
+		return err
+	}
+	if err := p.expect("ON", "after GRANT actions"); err != nil {
+		return err
+	}
+	if err := p.parseNameList("resource"); err != nil {
+		return err
+	}
+	if p.accept("WHERE") {
+		return p.parseCondition()
+	}
+	return nil
+}
+
+func (p *parser) parseNameList(what string) error {
+	for {
+		switch t := p.peek(); {
+		case t.is("*") || t.kind == tokenString:
+			p.next()
+		case t.kind == tokenIdent && !t.is("ON") && !t.is("WHERE"):
+			if err := p.parseQualifiedName(what); err != nil {
+				return err
+			}
+		default:
+			return p.unexpected(what, "")
+		}
+		if !p.accept(",") {
+			return nil
+		}
+	}
+}
+
+func (p *parser) parseUse() error {
+	p.next()
+	for {
+		if _, err := p.expectName("policy name"); err != nil {
+			return err
+		}
+		if !p.accept(".") {
+			break
+		}
+	}
+	if !p.accept("RESTRICT") {
+		return nil
+	}
+	for {
+		if err := p.parseCondition(); err != nil {
+			return err
+		}
+		if !p.accept(",") {
+			return nil
+		}
+	}
+}
+
+func (p *parser) parseQualifiedName(what string) error {
+	for {
+		p.accept("$")
+		if _, err := p.expectIdent(what); err != nil {
+			return err
+		}
+		if !p.accept(".") {
+			return nil
+		}
+	}
+}
+
+func (p *parser) parseCondition() error {
+	if err := p.parseAndCondition(); err != nil {
+		return err
+	}
+	for p.accept("OR") {
+		if err := p.parseAndCondition(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseAndCondition() error {
+	if err := p.parseNotCondition(); err != nil {
+		return err
+	}
+	for p.accept("AND") {
+		if err := p.parseNotCondition(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseNotCondition() error {
+	if p.accept("NOT") {
+		return p.parseNotCondition()
+	}
+	if p.accept("(") {
+		if err := p.parseCondition(); err != nil {
+			return err
+		}
+		return p.expect(")", "to close condition")
+	}
+	return p.parsePredicate()
+}
+
+func (p *parser) parsePredicate() error {
+	if err := p.parseOperand(); err != nil {
+		return err
+	}
+	t := p.peek()
+	switch {
+	case t.is("=") || t.is("<>") || t.is("!=") || t.is("<") || t.is("<=") || t.is(">") || t.is(">="):
+		p.next()
+		return p.parseOperand()
+	case t.is("IS"):
+		p.next()
+		p.accept("NOT")
+		if p.accept("RESTRICTED") {
+			return nil
+		}
+		return p.expect("NULL", "after IS")
+	case t.is("NOT"):
+		p.next()
+		return p.parseNegatablePredicate()
+	case t.is("BETWEEN") || t.is("IN") || t.is("LIKE"):
+		return p.parseNegatablePredicate()
+	}
+	// a single operand is a valid condition for boolean attributes
+	return nil
+}
+
+func (p *parser) parseNegatablePredicate() error {
+	switch t := p.peek(); {
+	case t.is("BETWEEN"):
+		p.next()
+		if err := p.parseOperand(); err != nil {
+			return err
+		}
+		if err := p.expect("AND", "in BETWEEN condition"); err != nil {
+			return err
+		}
+		return p.parseOperand()
+	case t.is("IN"):
+		p.next()
+		if !p.accept("(") {
+			return p.parseOperand()
+		}
+		for {
+			if err := p.parseOperand(); err != nil {
+				return err
+			}
+			if !p.accept(",") {
+				return p.expect(")", "to close IN list")
+			}
+		}
+	case t.is("LIKE"):
+		p.next()
+		if err := p.parseOperand(); err != nil {
+			return err
+		}
+		if p.accept("ESCAPE") {
+			return p.parseOperand()
+		}
+		return nil
+	default:
+		return p.unexpected("BETWEEN, IN or LIKE", "")
+	}
+}
+
+func (p *parser) parseOperand() error {
+	switch t := p.peek(); {
+	case t.kind == tokenString || t.kind == tokenNumber:
+		p.next()
+	case (t.is("-") || t.is("+")) && p.peekN(1).kind == tokenNumber:
+		p.next()
+		p.next()
+	case t.is("TRUE") || t.is("FALSE"):
+		p.next()
+	case t.kind == tokenIdent || t.is("$"):
+		if err := p.parseQualifiedName("attribute"); err != nil {
+			return err
+		}
+		if p.accept("(") {
+			return p.parseArguments()
+		}
+	default:
+		return p.unexpected("attribute or literal", "")
+	}
+	return nil
+}
+
+// parseArguments parses the arguments of a function call up to and including the closing parenthesis.
+func (p *parser) parseArguments() error {
+	for !p.accept(")") {
+		if err := p.parseOperand(); err != nil {
+			return err
+		}
+		if !p.accept(",") && !p.peek().is(")") {
+			return p.unexpected("',' or ')'", "in function call")
+		}
+	}
+	return nil
+}
+
+// parseAnnotations skips annotations like @label: 'text' or @valueHelp: { path: 'x' } that may precede declarations.
+func (p *parser) parseAnnotations() error {
+	for p.accept("@") {
+		if err := p.parseQualifiedName("annotation name"); err != nil {
+			return err
+		}
+		if p.accept(":") {
+			if err := p.parseAnnotationValue(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *parser) parseAnnotationValue() error {
+	switch {
+	case p.accept("{"):
+		for !p.accept("}") {
+			if p.peek().kind != tokenIdent && p.peek().kind != tokenString {
+				return p.unexpected("annotation property", "")
+			}
+			p.next()
+			if err := p.expect(":", "after annotation property"); err != nil {
+				return err
+			}
+			if err := p.parseAnnotationValue(); err != nil {
+				return err
+			}
+			if !p.accept(",") && !p.peek().is("}") {
+				return p.unexpected("',' or '}'", "in annotation")
+			}
+		}
+		return nil
+	case p.accept("["):
+		for !p.accept("]") {
+			if err := p.parseAnnotationValue(); err != nil {
+				return err
+			}
+			if !p.accept(",") && !p.peek().is("]") {
+				return p.unexpected("',' or ']'", "in annotation")
+			}
+		}
+		return nil
+	default:
+		return p.parseOperand()
+	}
+}
@@ -0,0 +1,119 @@
+package dcl
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SAP/cloud-authorization-buildpack/pkg/uploader"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		src        string
+		wantIssues []uploader.Dclssue
+	}{
+		{name: "schema", src: "SCHEMA {\n\tsalesOrderId: String\n}", wantIssues: nil},
+		{name: "nested schema with annotations and arrays", src: `SCHEMA {
+	@label: 'Sales Order'
+	salesOrder: {
+		id: Number,
+		@valueHelp: { path: 'Countries', valueField: 'ID', labelField: ['name'] }
+		country: String[]
+	},
+	public: Boolean,
+}`, wantIssues: nil},
+		{name: "policy", src: "POLICY salesOrderRead {\n\tGRANT read ON salesOrder where salesOrderId = '123';\n}", wantIssues: nil},
+		{name: "policy with comments and complex conditions", src: `// header comment
+/* block
+   comment */
+INTERNAL POLICY salesOrderWrite {
+	GRANT read, write ON salesOrder, 'invoice' WHERE (amount BETWEEN 1 AND 100 OR amount IS NULL)
+		AND country NOT IN ('DE', 'FR') AND name LIKE '%it''s%' AND NOT $app.user.active;
+	GRANT * ON * WHERE amount > -5;
+	USE cas.salesOrderRead RESTRICT salesOrderId = '1', salesOrderId IN $env.$user.orders;
+}
+DEFAULT POLICY readAll {
+	GRANT read ON *;
+}`, wantIssues: nil},
+		{name: "IS RESTRICTED", src: "POLICY p {\n\tUSE q RESTRICT country IS RESTRICTED, amount IS NOT RESTRICTED;\n\tGRANT read ON x WHERE a IS NOT RESTRICTED OR a = 1;\n}", wantIssues: nil},
+		{name: "quoted policy names", src: "POLICY \"My Policy\" {\n\tUSE cas.\"Other Policy\";\n}\nDEFAULT POLICY 'Read All' {\n\tGRANT read ON *;\n}", wantIssues: nil},
+		{name: "function", src: `FUNCTION isAdmin(user: String, level: Number) RETURNS Boolean {
+	RETURN user = 'admin' AND level > 2;
+}
+FUNCTION alwaysTrue() {
+	RETURN true
+}
+POLICY p {
+	GRANT read ON x WHERE isAdmin($app.user, 3) OR alwaysTrue();
+}`, wantIssues: nil},
+		{name: "function without RETURN", src: "FUNCTION f() {\n\tuser = 'admin';\n}\nPOLICY p {}", wantIssues: []uploader.Dclssue{
+			{Line: 2, Column: 2, Message: "expected 'RETURN' but found 'user' in FUNCTION body", SyntaxError: true, Severity: SeverityError},
+		}},
+		{name: "missing semicolon", src: "POLICY p {\n\tGRANT read ON salesOrder\n}", wantIssues: []uploader.Dclssue{
+			{Line: 3, Column: 1, Message: "expected ';' but found '}' at end of rule", SyntaxError: true, Severity: SeverityError},
+		}},
+		{name: "missing ON", src: "POLICY p {\n\tGRANT read salesOrder;\n}", wantIssues: []uploader.Dclssue{
+			{Line: 2, Column: 13, Message: "expected 'ON' but found 'salesOrder' after GRANT actions", SyntaxError: true, Severity: SeverityError},
+		}},
+		{name: "continues after broken rule", src: "POLICY p {\n\tGRANT read ON x WHERE a = ;\n\tGRANT ON x;\n\tGRANT read ON x;\n}", wantIssues: []uploader.Dclssue{
+			{Line: 2, Column: 28, Message: "expected attribute or literal but found ';'", SyntaxError: true, Severity: SeverityError},
+			{Line: 3, Column: 8, Message: "expected action but found 'ON'", SyntaxError: true, Severity: SeverityError},
+		}},
+		{name: "unterminated string", src: "POLICY p {\n\tGRANT read ON x WHERE a = 'abc;\n}", wantIssues: []uploader.Dclssue{
+			{Line: 2, Column: 28, Message: "unterminated string literal", SyntaxError: true, Severity: SeverityError},
+			{Line: 3, Column: 1, Message: "expected ';' but found '}' at end of rule", SyntaxError: true, Severity: SeverityError},
+		}},
+		{name: "unclosed policy", src: "POLICY p {\n\tGRANT read ON x;\n", wantIssues: []uploader.Dclssue{
+			{Line: 3, Column: 1, Message: "expected '}' but found end of file to close POLICY p", SyntaxError: true, Severity: SeverityError},
+		}},
+		{name: "illegal character", src: "POLICY p {\n\tGRANT read ON x WHERE a # 1;\n}", wantIssues: []uploader.Dclssue{
+			{Line: 2, Column: 26, Message: "unexpected character '#'", SyntaxError: true, Severity: SeverityError},
+		}},
+		{name: "unknown top level keyword", src: "POLICIES 123 {}", wantIssues: []uploader.Dclssue{
+			{Line: 1, Column: 1, Message: "expected SCHEMA, POLICY or FUNCTION but found 'POLICIES'", SyntaxError: true, Severity: SeverityError},
+		}},
+		{name: "duplicate policy", src: "POLICY p {}\nPOLICY P {}", wantIssues: []uploader.Dclssue{
+			{Line: 2, Column: 8, Message: "duplicate policy 'P'", Severity: SeverityError},
+		}},
+		{name: "schema issues", src: "SCHEMA {\n\ta: String,\n\ta: Date\n}", wantIssues: []uploader.Dclssue{
+			{Line: 3, Column: 2, Message: "duplicate attribute 'a'", Severity: SeverityError},
+			{Line: 3, Column: 5, Message: "unknown attribute type 'Date'", Severity: SeverityWarning},
+		}},
+		{name: "schema missing comma", src: "SCHEMA {\n\ta: String\n\tb: String\n}", wantIssues: []uploader.Dclssue{
+			{Line: 3, Column: 2, Message: "expected ',' or '}' but found 'b' in SCHEMA", SyntaxError: true, Severity: SeverityError},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.wantIssues, Parse([]byte(tt.src)))
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(root, "cas"), 0700))
+	require.NoError(t, os.WriteFile(path.Join(root, "schema.dcl"), []byte("SCHEMA {\n\tsalesOrderId: String\n}"), 0600))
+	require.NoError(t, os.WriteFile(path.Join(root, "cas", "policy.dcl"), []byte("POLICY p {\n\tGRANT read ON x WHERE;\n}"), 0600))
+	require.NoError(t, os.WriteFile(path.Join(root, "cas", "data.json"), []byte("{"), 0600))
+
+	issues, err := Validate([]string{root}, uploader.FileFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]uploader.Dclssue{"cas/policy.dcl": {
+		{Line: 2, Column: 23, Message: "expected attribute or literal but found ';'", SyntaxError: true, Severity: SeverityError},
+	}}, issues)
+	assert.Equal(t, 1, CountErrors(issues))
+}
+
+func TestValidateFixtures(t *testing.T) {
+	for _, root := range []string{"../../fixtures/node_with_opa", "../supply/testdata/policies"} {
+		issues, err := Validate([]string{root}, uploader.FileFilter{})
+		require.NoError(t, err)
+		assert.Empty(t, issues, root)
+	}
+}
@@ -0,0 +1,45 @@
+package dcl
+
+import (
+	"os"
+	"strings"
+
+	"github.com/SAP/cloud-authorization-buildpack/pkg/uploader"
+)
+
+// Validate parses every .dcl file of the roots that passes the filter, i.e. every DCL file that would be uploaded.
+// The returned issues are keyed by the slash separated path of the file relative to its root, like the dclIssues
+// of a CompileError returned by the AMS server.
+func Validate(roots []string, filter uploader.FileFilter) (map[string][]uploader.Dclssue, error) {
+	files, err := uploader.ListFiles(roots, filter)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string][]uploader.Dclssue)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name, ".dcl") {
+			continue
+		}
+		src, err := os.ReadFile(file.Path)
+		if err != nil {
+			return nil, err
+		}
+		if issues := Parse(src); len(issues) > 0 {
+			result[file.Name] = issues
+		}
+	}
+	return result, nil
+}
+
+// CountErrors returns the number of issues with severity ERROR.
+func CountErrors(issues map[string][]uploader.Dclssue) int {
+	var count int
+	for _, fileIssues := range issues {
+		for _, issue := range fileIssues {
+			if issue.Severity == SeverityError {
+				count++
+			}
+		}
+	}
+	return count
+}
@@ -2,18 +2,93 @@ package env
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cloudfoundry/libbuildpack"
 )
 
-const HeaderInstanceID = "X-Ams-Instance-Id"
+const (
+	HeaderInstanceID = "X-Ams-Instance-Id"
+	HeaderDCLDigest  = "X-Ams-Dcl-Digest"
+)
+
+// Sources of the authorization bundles that are downloaded by the AMS sidecar, configured by AMS_BUNDLE_SOURCE.
+const (
+	BundleSourceGateway     = "gateway"
+	BundleSourceObjectStore = "object-store"
+)
+
+// Modes of the decision logs of the AMS sidecar, configured by AMS_DECISION_LOGS.
+const (
+	DecisionLogsOff     = "off"
+	DecisionLogsConsole = "console"
+	DecisionLogsRemote  = "remote"
+)
+
+const (
+	defaultPollMinDelay   = 10 * time.Second
+	defaultPollMaxDelay   = 20 * time.Second
+	defaultMaxArchiveSize = 10 << 20
+	defaultUploadTimeout  = 5 * time.Minute
+	defaultContextLines   = 2
+)
 
 type Config struct {
-	Root         string
+	Roots        []string
+	Include      []string
+	Exclude      []string
 	ShouldUpload bool
+	ValidateDCL  bool
+	ForceUpload  bool
+	DryRun       bool
+	// MaxArchiveSize is the maximum size of the compressed policy archive in bytes
+	MaxArchiveSize int64
+	// UploadTimeout limits the duration of the policy upload including all retries, 0 means no limit
+	UploadTimeout time.Duration
+	// ReportDir is the directory for the SARIF and JUnit reports of DCL issues, empty means the deps dir
+	ReportDir        string
+	ReportInBuildDir bool
+	// ContextLines is the number of DCL source lines printed around each issue
+	ContextLines int
 	LogLevel     string
 	Port         int
+	// BundleSource is where the AMS sidecar downloads the authorization bundles from
+	BundleSource  string
+	BundlePolling BundlePolling
+	// PersistBundle lets the AMS sidecar persist downloaded bundles and activate them at startup
+	PersistBundle bool
+	// BundleSeed is a bundle file of the app that is persisted at staging, empty means none
+	BundleSeed string
+	// PrefetchBundle downloads the bundle at staging and persists it as initial bundle
+	PrefetchBundle bool
+	// OPAConfigOverlay is merged into the generated OPA config, inline JSON or YAML or a file in the app
+	OPAConfigOverlay string
+	DecisionLogs     DecisionLogs
+}
+
+// DecisionLogs configures which authorization decisions the AMS sidecar logs and where.
+type DecisionLogs struct {
+	Mode string
+	// URL is the decision log service of the remote mode
+	URL string
+	// Mask contains the JSON pointers of the fields that are removed from the logged decisions, like /input/password
+	Mask []string
+	// BufferSizeLimit and UploadSizeLimit are the limits of the remote mode in bytes, 0 means the OPA default
+	BufferSizeLimit int64
+	UploadSizeLimit int64
+}
+
+// BundlePolling configures how often the AMS sidecar checks for a new authorization bundle.
+type BundlePolling struct {
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// LongPollingTimeout enables long polling if the server supports it, 0 means periodic polling
+	LongPollingTimeout time.Duration
 }
 
 type amsDataDeprecated struct {
@@ -37,34 +112,264 @@ func LoadVcapApplication(log *libbuildpack.Logger) VcapApplication {
 }
 
 func LoadBuildpackConfig(log *libbuildpack.Logger) (Config, error) {
+	var cfg Config
+	var err error
+	if cfg.BundleSource, err = LoadBundleSource(); err != nil {
+		return cfg, err
+	}
+	if cfg.BundlePolling, err = loadBundlePolling(log, cfg.BundleSource); err != nil {
+		return cfg, err
+	}
+	if cfg.PersistBundle, err = lookupBool("AMS_BUNDLE_PERSIST", false); err != nil {
+		return cfg, err
+	}
+	cfg.BundleSeed = os.Getenv("AMS_BUNDLE_SEED")
+	if cfg.BundleSeed != "" && !cfg.PersistBundle {
+		return cfg, fmt.Errorf("AMS_BUNDLE_SEED requires AMS_BUNDLE_PERSIST=true")
+	}
+	if cfg.PrefetchBundle, err = lookupBool("AMS_BUNDLE_PREFETCH", false); err != nil {
+		return cfg, err
+	}
+	if cfg.PrefetchBundle && !cfg.PersistBundle {
+		return cfg, fmt.Errorf("AMS_BUNDLE_PREFETCH requires AMS_BUNDLE_PERSIST=true")
+	}
+	if cfg.PrefetchBundle && cfg.BundleSource != BundleSourceGateway {
+		return cfg, fmt.Errorf("AMS_BUNDLE_PREFETCH is only supported for AMS_BUNDLE_SOURCE=%s", BundleSourceGateway)
+	}
+	cfg.OPAConfigOverlay = os.Getenv("AMS_OPA_CONFIG_OVERLAY")
+	if cfg.DecisionLogs, err = loadDecisionLogs(); err != nil {
+		return cfg, err
+	}
 	// Deprecated compatibility coding to support AMS_DATA for now (AMS_DATA.serviceNname will be ignored, because its not supposed to be supported by stakeholders)
 	amsData, amsDataSet := os.LookupEnv("AMS_DATA")
 	if amsDataSet {
 		log.Warning("the environment variable AMS_DATA is deprecated. Please use $AMS_DCL_ROOT to provide Base DCL application (see https://github.com/SAP/cloud-authorization-buildpack/blob/main/README.md#base-policy-upload)")
 		var amsD amsDataDeprecated
-		err := json.Unmarshal([]byte(amsData), &amsD)
-		return Config{
-			Root:         amsD.Root,
-			ShouldUpload: amsD.Root != "",
-			LogLevel:     "info",
-			Port:         9888,
-		}, err
+		if err := json.Unmarshal([]byte(amsData), &amsD); err != nil {
+			return cfg, err
+		}
+		if amsD.Root != "" {
+			cfg.Roots = []string{amsD.Root}
+		}
+		cfg.ShouldUpload = amsD.Root != ""
+		cfg.LogLevel = "info"
+		cfg.Port = 9888
+		return cfg, loadUploadConfig(&cfg)
 	}
 	// End of Deprecated coding
 
-	dclRoot := os.Getenv("AMS_DCL_ROOT")
-	shouldUpload := dclRoot != ""
-	if !shouldUpload {
+	cfg.Roots = parseList(os.Getenv("AMS_DCL_ROOT"))
+	cfg.ShouldUpload = len(cfg.Roots) > 0
+	if !cfg.ShouldUpload {
 		log.Warning("this app will upload no authorization data (AMS_DCL_ROOT empty or not set)")
 	}
-	logLevel := os.Getenv("AMS_LOG_LEVEL")
-	if logLevel == "" {
-		logLevel = "error"
+	cfg.LogLevel = os.Getenv("AMS_LOG_LEVEL")
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "error"
+	}
+	cfg.Port = 9888
+	return cfg, loadUploadConfig(&cfg)
+}
+
+// LoadBundleSource returns the bundle source configured by AMS_BUNDLE_SOURCE, the bundle gateway by default. It is
+// read during staging and by cert-to-disk at startup.
+func LoadBundleSource() (string, error) {
+	switch v := os.Getenv("AMS_BUNDLE_SOURCE"); v {
+	case "", BundleSourceGateway:
+		return BundleSourceGateway, nil
+	case BundleSourceObjectStore:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid value for AMS_BUNDLE_SOURCE: '%s', supported are '%s' and '%s'", v, BundleSourceGateway, BundleSourceObjectStore)
+	}
+}
+
+// loadBundlePolling reads AMS_BUNDLE_POLL_MIN, AMS_BUNDLE_POLL_MAX and AMS_BUNDLE_LONG_POLLING_TIMEOUT. If only one
+// of the delays is set, the default of the other one is adjusted so that the minimum does not exceed the maximum.
+func loadBundlePolling(log *libbuildpack.Logger, bundleSource string) (BundlePolling, error) {
+	p := BundlePolling{MinDelay: defaultPollMinDelay, MaxDelay: defaultPollMaxDelay}
+	minSet, maxSet := false, false
+	for _, v := range []struct {
+		name string
+		dst  *time.Duration
+		set  *bool
+	}{
+		{"AMS_BUNDLE_POLL_MIN", &p.MinDelay, &minSet},
+		{"AMS_BUNDLE_POLL_MAX", &p.MaxDelay, &maxSet},
+		{"AMS_BUNDLE_LONG_POLLING_TIMEOUT", &p.LongPollingTimeout, new(bool)},
+	} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		d, err := parseDuration(s)
+		if err != nil {
+			return p, fmt.Errorf("invalid value for %s: %w", v.name, err)
+		}
+		if d < time.Second || d%time.Second != 0 {
+			return p, fmt.Errorf("invalid value for %s: '%s' is not a whole number of seconds of at least 1s", v.name, s)
+		}
+		*v.dst, *v.set = d, true
+	}
+	switch {
+	case minSet && !maxSet && p.MinDelay > p.MaxDelay:
+		p.MaxDelay = p.MinDelay
+	case maxSet && !minSet && p.MaxDelay < p.MinDelay:
+		p.MinDelay = p.MaxDelay
+	case p.MinDelay > p.MaxDelay:
+		return p, fmt.Errorf("AMS_BUNDLE_POLL_MIN (%s) must not be greater than AMS_BUNDLE_POLL_MAX (%s)", p.MinDelay, p.MaxDelay)
+	}
+	if p.LongPollingTimeout > 0 && bundleSource == BundleSourceObjectStore {
+		log.Warning("the object store does not support long polling, the AMS sidecar falls back to polling every %s to %s", p.MinDelay, p.MaxDelay)
+	}
+	return p, nil
+}
+
+// loadDecisionLogs reads AMS_DECISION_LOGS and the settings of its modes.
+func loadDecisionLogs() (DecisionLogs, error) {
+	d := DecisionLogs{Mode: os.Getenv("AMS_DECISION_LOGS")}
+	switch d.Mode {
+	case "":
+		d.Mode = DecisionLogsOff
+	case DecisionLogsOff, DecisionLogsConsole, DecisionLogsRemote:
+	default:
+		return d, fmt.Errorf("invalid value for AMS_DECISION_LOGS: '%s', supported are '%s', '%s' and '%s'", d.Mode, DecisionLogsOff, DecisionLogsConsole, DecisionLogsRemote)
+	}
+
+	d.URL = os.Getenv("AMS_DECISION_LOGS_URL")
+	if d.Mode == DecisionLogsRemote {
+		if u, err := url.Parse(d.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return d, fmt.Errorf("AMS_DECISION_LOGS=%s requires the absolute URL of the decision log service in AMS_DECISION_LOGS_URL", DecisionLogsRemote)
+		}
+	}
+	d.Mask = parseList(os.Getenv("AMS_DECISION_LOGS_MASK"))
+	if len(d.Mask) > 0 && d.Mode == DecisionLogsOff {
+		return d, fmt.Errorf("AMS_DECISION_LOGS_MASK is only supported for AMS_DECISION_LOGS=%s or %s", DecisionLogsConsole, DecisionLogsRemote)
 	}
-	return Config{
-		Root:         dclRoot,
-		ShouldUpload: shouldUpload,
-		LogLevel:     logLevel,
-		Port:         9888,
-	}, nil
+	for _, ptr := range d.Mask {
+		if !strings.HasPrefix(ptr, "/input/") && ptr != "/result" && !strings.HasPrefix(ptr, "/result/") {
+			return d, fmt.Errorf("invalid value for AMS_DECISION_LOGS_MASK: '%s' is no JSON pointer to a field of /input or /result", ptr)
+		}
+	}
+	for _, v := range []struct {
+		name string
+		dst  *int64
+	}{
+		{"AMS_DECISION_LOGS_BUFFER_SIZE", &d.BufferSizeLimit},
+		{"AMS_DECISION_LOGS_UPLOAD_SIZE", &d.UploadSizeLimit},
+	} {
+		s := os.Getenv(v.name)
+		if s == "" {
+			continue
+		}
+		if d.Mode != DecisionLogsRemote {
+			return d, fmt.Errorf("%s is only supported for AMS_DECISION_LOGS=%s", v.name, DecisionLogsRemote)
+		}
+		size, err := parseSize(s)
+		if err != nil {
+			return d, fmt.Errorf("invalid value for %s: %w", v.name, err)
+		}
+		*v.dst = size
+	}
+	return d, nil
+}
+
+func loadUploadConfig(cfg *Config) error {
+	var err error
+	cfg.Include = parseList(os.Getenv("AMS_DCL_INCLUDE"))
+	cfg.Exclude = parseList(os.Getenv("AMS_DCL_EXCLUDE"))
+	if cfg.ValidateDCL, err = lookupBool("AMS_DCL_VALIDATE", true); err != nil {
+		return err
+	}
+	if cfg.ForceUpload, err = lookupBool("AMS_FORCE_UPLOAD", false); err != nil {
+		return err
+	}
+	if cfg.DryRun, err = lookupBool("AMS_UPLOAD_DRY_RUN", false); err != nil {
+		return err
+	}
+	cfg.ReportDir = os.Getenv("AMS_DCL_REPORT_DIR")
+	if cfg.ReportInBuildDir, err = lookupBool("AMS_DCL_REPORT_IN_BUILD_DIR", false); err != nil {
+		return err
+	}
+	cfg.ContextLines = defaultContextLines
+	if v := os.Getenv("AMS_DCL_CONTEXT_LINES"); v != "" {
+		if cfg.ContextLines, err = strconv.Atoi(v); err != nil || cfg.ContextLines < 0 {
+			return fmt.Errorf("invalid value for AMS_DCL_CONTEXT_LINES: '%s' is not a non-negative number", v)
+		}
+	}
+	cfg.MaxArchiveSize = defaultMaxArchiveSize
+	if v := os.Getenv("AMS_DCL_MAX_ARCHIVE_SIZE"); v != "" {
+		if cfg.MaxArchiveSize, err = parseSize(v); err != nil {
+			return fmt.Errorf("invalid value for AMS_DCL_MAX_ARCHIVE_SIZE: %w", err)
+		}
+	}
+	cfg.UploadTimeout = defaultUploadTimeout
+	if v := os.Getenv("AMS_UPLOAD_TIMEOUT"); v != "" {
+		if cfg.UploadTimeout, err = parseDuration(v); err != nil {
+			return fmt.Errorf("invalid value for AMS_UPLOAD_TIMEOUT: %w", err)
+		}
+	}
+	return nil
+}
+
+// parseDuration parses a duration like "90s" or "5m", a plain number is interpreted as seconds.
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		s = strconv.FormatInt(n, 10) + "s"
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %s", d)
+	}
+	return d, nil
+}
+
+// parseSize parses a size in bytes with an optional binary unit suffix, like "512K", "10M" or "1G".
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := int64(1)
+	for i, unit := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(s, unit) {
+			multiplier = 1 << (10 * (i + 1))
+			s = strings.TrimSuffix(s, unit)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative size %d", n)
+	}
+	return n * multiplier, nil
+}
+
+// lookupBool parses the boolean environment variable name, returning def if it is not set.
+func lookupBool(name string, def bool) (bool, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for %s: %w", name, err)
+	}
+	return b, nil
+}
+
+// parseList splits a comma or newline separated list and drops empty entries.
+func parseList(s string) []string {
+	var result []string
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
 }
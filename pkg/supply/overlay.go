@@ -0,0 +1,132 @@
+package supply
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/config"
+	"github.com/open-policy-agent/opa/plugins/bundle"
+	"github.com/open-policy-agent/opa/plugins/logs"
+	"github.com/open-policy-agent/opa/util"
+)
+
+// deniedOverlayKeys returns the paths of the OPA config that are owned by the buildpack and must not be changed by
+// AMS_OPA_CONFIG_OVERLAY.
+func deniedOverlayKeys(instanceID string) [][]string {
+	return [][]string{
+		{"services", bundleServiceKey, "url"},
+		{"services", bundleServiceKey, "headers"},
+		{"services", bundleServiceKey, "credentials"},
+		{"services", decisionLogsServiceKey, "credentials"},
+		{"bundles", instanceID, "service"},
+		{"bundles", instanceID, "resource"},
+		{"persistence_directory"},
+	}
+}
+
+// loadOPAConfigOverlay returns the overlay of AMS_OPA_CONFIG_OVERLAY, which is either the path of a JSON or YAML file
+// in the app, relative to the app root, or an inline JSON or YAML object.
+func (s *Supplier) loadOPAConfigOverlay(overlay string) (map[string]interface{}, error) {
+	raw := []byte(overlay)
+	name := overlay
+	if !path.IsAbs(name) {
+		name = path.Join(s.Stager.BuildDir(), name)
+	}
+	if b, err := os.ReadFile(name); err == nil {
+		s.Log.Info("using the OPA config overlay from '%s'", name)
+		raw = b
+	}
+	var result map[string]interface{}
+	if err := util.Unmarshal(raw, &result); err != nil || result == nil {
+		return nil, fmt.Errorf("AMS_OPA_CONFIG_OVERLAY is neither a file in the app nor a JSON or YAML object")
+	}
+	return result, nil
+}
+
+// applyOPAConfigOverlay deep-merges the overlay into the generated config of the AMS instance. Objects are merged, all
+// other values of the overlay replace the generated ones.
+func applyOPAConfigOverlay(cfg OPAConfig, instanceID string, overlay map[string]interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var merged map[string]interface{}
+	if err := json.Unmarshal(raw, &merged); err != nil {
+		return nil, err
+	}
+	if err := mergeOverlay(merged, overlay, nil, deniedOverlayKeys(instanceID)); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+func mergeOverlay(dst, src map[string]interface{}, parent []string, denied [][]string) error {
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := append(append([]string{}, parent...), k)
+		srcMap, srcIsMap := src[k].(map[string]interface{})
+		dstMap, dstIsMap := dst[k].(map[string]interface{})
+		if isDeniedOverlayKey(p, srcIsMap, denied) {
+			return fmt.Errorf("AMS_OPA_CONFIG_OVERLAY must not set '%s', it is configured by the buildpack", strings.Join(p, "."))
+		}
+		if srcIsMap && dstIsMap {
+			if err := mergeOverlay(dstMap, srcMap, p, denied); err != nil {
+				return err
+			}
+			continue
+		}
+		dst[k] = src[k]
+	}
+	return nil
+}
+
+// isDeniedOverlayKey reports whether setting the path changes a denied key. Objects are merged, so they only change a
+// denied key if the path is the denied key or below it, other values also replace everything below the path.
+func isDeniedOverlayKey(p []string, isMap bool, denied [][]string) bool {
+	for _, d := range denied {
+		if isMap && len(p) < len(d) {
+			continue
+		}
+		n := min(len(p), len(d))
+		if slices.Equal(p[:n], d[:n]) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateOPAConfig parses the config with the parsers of OPA, so that staging fails instead of the sidecar.
+func validateOPAConfig(raw []byte) error {
+	cfg, err := config.ParseConfig(raw, "ams")
+	if err != nil {
+		return fmt.Errorf("invalid OPA config: %w", err)
+	}
+	var svcs map[string]json.RawMessage
+	if err := util.Unmarshal(cfg.Services, &svcs); err != nil {
+		return fmt.Errorf("invalid OPA config: services must be an object: %w", err)
+	}
+	names := make([]string, 0, len(svcs))
+	for name := range svcs {
+		names = append(names, name)
+	}
+	if _, err := bundle.ParseBundlesConfig(cfg.Bundles, names); err != nil {
+		return fmt.Errorf("invalid OPA config: %w", err)
+	}
+	pluginNames := make([]string, 0, len(cfg.Plugins))
+	for name := range cfg.Plugins {
+		pluginNames = append(pluginNames, name)
+	}
+	if _, err := logs.ParseConfig(cfg.DecisionLogs, names, pluginNames); err != nil {
+		return fmt.Errorf("invalid OPA config: %w", err)
+	}
+	return nil
+}
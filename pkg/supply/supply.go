@@ -6,16 +6,24 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/cloudfoundry/libbuildpack"
+	"github.com/go-playground/validator/v10"
+	opabundle "github.com/open-policy-agent/opa/bundle"
 	"github.com/open-policy-agent/opa/download"
 	"github.com/open-policy-agent/opa/plugins/bundle"
 
 	"github.com/SAP/cloud-authorization-buildpack/pkg/common/services"
+	"github.com/SAP/cloud-authorization-buildpack/pkg/dcl"
 	"github.com/SAP/cloud-authorization-buildpack/pkg/supply/env"
 	"github.com/SAP/cloud-authorization-buildpack/pkg/uploader"
+	"github.com/SAP/cloud-authorization-buildpack/pkg/valuehelp"
 )
 
 type Manifest interface {
@@ -78,7 +86,7 @@ func (s *Supplier) Run() error {
 	if err != nil {
 		return fmt.Errorf("could not load buildpack Config: %w", err)
 	}
-	identityCreds, err := services.LoadServiceCredentials(s.Log)
+	identityCreds, err := services.LoadServiceCredentials(s.Log, s.Stager.BuildDir())
 	if err != nil {
 		return fmt.Errorf("could not load AMSCredentials: %w", err)
 	}
@@ -92,20 +100,30 @@ func (s *Supplier) Run() error {
 	if err := s.supplyCertCopier(); err != nil {
 		return fmt.Errorf("could not supply cert-to-disk binary: %w", err)
 	}
-	if err := s.writeLaunchConfig(cfg); err != nil {
+	if err := s.writeLaunchConfig(cfg, identityCreds); err != nil {
 		return fmt.Errorf("could not write launch config: %w", err)
 	}
-	if err := s.writeOpaConfig(identityCreds, tlsCfg); err != nil {
+	if err := s.writeOpaConfig(identityCreds, tlsCfg, cfg); err != nil {
 		return fmt.Errorf("could not write opa config: %w", err)
 	}
-	if err := s.writeProfileDFile(cfg); err != nil {
+	if cfg.BundleSeed != "" {
+		if err := s.seedBundle(identityCreds.AmsInstanceID, cfg.BundleSeed); err != nil {
+			return fmt.Errorf("could not seed the persisted bundle: %w", err)
+		}
+	}
+	if err := s.writeProfileDFile(cfg, identityCreds); err != nil {
 		return fmt.Errorf("could not write profileD file: %w", err)
 	}
 	if cfg.ShouldUpload {
-		if err := s.upload(identityCreds, tlsCfg, cfg.Root); err != nil {
+		if err := s.upload(identityCreds, tlsCfg, cfg); err != nil {
 			return fmt.Errorf("error uploading policies: %w", err)
 		}
 	}
+	if cfg.PrefetchBundle {
+		if err := s.prefetchBundle(identityCreds, tlsCfg, cfg.DecisionLogs); err != nil {
+			return fmt.Errorf("could not prefetch the bundle: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -126,6 +144,9 @@ func (s *Supplier) getTLSConfig(identityCreds *services.IASCredentials) (tlsConf
 		if err != nil {
 			return tlsConfig{}, fmt.Errorf("unable to read CF_INSTANCE_KEY certificate: %s", err)
 		}
+		if err := services.CheckRotatedCertificate(s.Log, "CF instance", cert, key); err != nil {
+			return tlsConfig{}, err
+		}
 		return tlsConfig{
 			CertPath: "${CF_INSTANCE_CERT}",
 			KeyPath:  "${CF_INSTANCE_KEY}",
@@ -148,10 +169,35 @@ type ClientTLS struct {
 	Key  string `json:"private_key,omitempty"`
 }
 
+// OAuth2 configures OPA's client credentials grant. The client secret is not written to the config at staging, it is
+// set from the file written by cert-to-disk at startup.
+type OAuth2 struct {
+	GrantType string `json:"grant_type"`
+	TokenURL  string `json:"token_url"`
+	ClientID  string `json:"client_id"`
+}
+
+// S3Signing configures OPA's AWS signature for bundles from the object store. The access keys are read from the AWS
+// credentials file written by cert-to-disk at startup.
+type S3Signing struct {
+	ProfileCredentials *AWSProfileCredentials `json:"profile_credentials"`
+}
+
+type AWSProfileCredentials struct {
+	Path    string `json:"path"`
+	Profile string `json:"profile"`
+	Region  string `json:"aws_region"`
+}
+
 type Credentials struct {
 	ClientTLS *ClientTLS `json:"client_tls,omitempty"` // storage gateway bundle access
+	OAuth2    *OAuth2    `json:"oauth2,omitempty"`     // bundle access of identity bindings with a client secret
+	S3Signing *S3Signing `json:"s3_signing,omitempty"` // bundle access via the object store
 }
 
+// clientSecretConfigKey is the path of the client secret of a service in the OPA config, which is set with --set-file.
+const clientSecretConfigKey = "services.%s.credentials.oauth2.client_secret"
+
 type OPARestConfig struct {
 	URL         string `json:"url"`
 	Headers     map[string]string
@@ -159,18 +205,57 @@ type OPARestConfig struct {
 }
 
 type OPAConfig struct {
-	Bundles  map[string]*bundle.Source `json:"bundles"`
-	Services map[string]OPARestConfig  `json:"services"`
-	Plugins  map[string]bool           `json:"plugins,omitempty"`
-	Status   map[string]string         `json:"status,omitempty"`
+	Bundles              map[string]*bundle.Source `json:"bundles"`
+	Services             map[string]OPARestConfig  `json:"services"`
+	Plugins              map[string]bool           `json:"plugins,omitempty"`
+	Status               map[string]string         `json:"status,omitempty"`
+	PersistenceDirectory string                    `json:"persistence_directory,omitempty"`
+	DecisionLogs         *DecisionLogsConfig       `json:"decision_logs,omitempty"`
 }
 
-func (s *Supplier) writeProfileDFile(cfg env.Config) error {
+type DecisionLogsConfig struct {
+	Console   bool                   `json:"console,omitempty"`
+	Service   string                 `json:"service,omitempty"`
+	Reporting *DecisionLogsReporting `json:"reporting,omitempty"`
+}
+
+type DecisionLogsReporting struct {
+	BufferSizeLimitBytes *int64 `json:"buffer_size_limit_bytes,omitempty"`
+	UploadSizeLimitBytes *int64 `json:"upload_size_limit_bytes,omitempty"`
+}
+
+const (
+	decisionLogsServiceKey = "decision_logs"
+	// decisionLogMaskBundle is the directory of the bundle with the policy data.system.log.mask, with which OPA masks
+	// the logged decisions. A loose policy file would be erased by OPA when it activates the AMS bundle.
+	decisionLogMaskBundle = "decision_log_mask"
+	// decisionLogMaskRoot is the only root of the mask bundle, so that it doesn't overlap with the AMS bundle.
+	decisionLogMaskRoot = "system/log"
+)
+
+// opaPersistenceDir is the directory in the deps dir in which OPA persists the downloaded bundles.
+const opaPersistenceDir = "opa_persistence"
+
+func (s *Supplier) writeProfileDFile(cfg env.Config, creds *services.IASCredentials) error {
 	s.Log.Info("writing profileD file..")
 	values := map[string]string{
 		"OPA_URL": fmt.Sprintf("http://127.0.0.1:%d/", cfg.Port),
 		"ADC_URL": fmt.Sprintf("http://127.0.0.1:%d/", cfg.Port),
 	}
+	// the expected value-help certificate is exported for the verification with the package valuehelp
+	for k, dn := range map[string]*services.DistinguishedName{
+		valuehelp.IssuerEnv:  creds.AmsValueHelpCertIssuer,
+		valuehelp.SubjectEnv: creds.AmsValueHelpCertSubject,
+	} {
+		if dn == nil {
+			continue
+		}
+		b, err := json.Marshal(dn)
+		if err != nil {
+			return fmt.Errorf("could not marshal %s: %w", k, err)
+		}
+		values[k] = "'" + strings.ReplaceAll(string(b), "'", `'\''`) + "'"
+	}
 
 	var b bytes.Buffer
 	for k, v := range values {
@@ -184,40 +269,73 @@ func (s *Supplier) writeProfileDFile(cfg env.Config) error {
 	return os.WriteFile(path.Join(s.Stager.ProfileDir(), "0000_opa_env.sh"), b.Bytes(), 0755) //nolint
 }
 
-func (s *Supplier) writeOpaConfig(creds *services.IASCredentials, tlsCfg tlsConfig) error {
+func (s *Supplier) writeOpaConfig(creds *services.IASCredentials, tlsCfg tlsConfig, bpCfg env.Config) error {
 	s.Log.Info("writing opa config..")
 
-	cfg := s.createBundleGatewayConfig(creds, tlsCfg)
+	cfg := s.createBundleGatewayConfig(creds, tlsCfg, bpCfg.BundlePolling)
+	if bpCfg.BundleSource == env.BundleSourceObjectStore {
+		svc, err := s.createObjectStoreService(creds)
+		if err != nil {
+			return err
+		}
+		cfg.Services[bundleServiceKey] = svc
+	}
+	if bpCfg.PersistBundle {
+		cfg.Bundles[creds.AmsInstanceID].Persist = true
+		cfg.PersistenceDirectory = path.Join("/home/vcap/deps/", s.Stager.DepsIdx(), opaPersistenceDir)
+	}
+	if err := s.createDecisionLogsConfig(&cfg, creds, tlsCfg, bpCfg.DecisionLogs); err != nil {
+		return fmt.Errorf("could not configure decision logs: %w", err)
+	}
 	cfg.Plugins = map[string]bool{"dcl": true}
 	cfg.Status = map[string]string{"plugin": "dcl"}
+
+	var result interface{} = cfg
+	if bpCfg.OPAConfigOverlay != "" {
+		overlay, err := s.loadOPAConfigOverlay(bpCfg.OPAConfigOverlay)
+		if err != nil {
+			return err
+		}
+		if result, err = applyOPAConfigOverlay(cfg, creds.AmsInstanceID, overlay); err != nil {
+			return err
+		}
+	}
 	filePath := path.Join(s.Stager.DepDir(), "opa_config.yml")
-	bCfg, _ := json.Marshal(cfg)
+	bCfg, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
 	s.Log.Debug("OPA config: '%s'", string(bCfg))
-	return libbuildpack.NewJSON().Write(filePath, cfg)
+	if err := validateOPAConfig(bCfg); err != nil {
+		return err
+	}
+	return libbuildpack.NewJSON().Write(filePath, result)
 }
 
-func (s *Supplier) createBundleGatewayConfig(cred *services.IASCredentials, cfg tlsConfig) OPAConfig {
-	serviceKey := "bundle_storage"
+const bundleServiceKey = "bundle_storage"
+
+func (s *Supplier) createBundleGatewayConfig(cred *services.IASCredentials, cfg tlsConfig, polling env.BundlePolling) OPAConfig {
+	pollingCfg := download.PollingConfig{
+		MinDelaySeconds: newInt64P(int64(polling.MinDelay / time.Second)),
+		MaxDelaySeconds: newInt64P(int64(polling.MaxDelay / time.Second)),
+	}
+	if polling.LongPollingTimeout > 0 {
+		pollingCfg.LongPollingTimeoutSeconds = newInt64P(int64(polling.LongPollingTimeout / time.Second))
+	}
 	bundles := make(map[string]*bundle.Source)
 	bundles[cred.AmsInstanceID] = &bundle.Source{
 		Config: download.Config{
-			Polling: download.PollingConfig{
-				MinDelaySeconds: newInt64P(10),
-				MaxDelaySeconds: newInt64P(20),
-			},
+			Polling: pollingCfg,
 		},
-		Service: serviceKey,
+		Service: bundleServiceKey,
 
 		Resource: cred.AmsInstanceID + ".tar.gz",
 	}
 	svcs := make(map[string]OPARestConfig)
-	svcs[serviceKey] = OPARestConfig{
-		URL:     cred.AmsBundleGatewayURL,
-		Headers: map[string]string{env.HeaderInstanceID: cred.AmsInstanceID},
-		Credentials: Credentials{ClientTLS: &ClientTLS{
-			Cert: cfg.CertPath,
-			Key:  cfg.KeyPath,
-		}},
+	svcs[bundleServiceKey] = OPARestConfig{
+		URL:         cred.AmsBundleGatewayURL,
+		Headers:     map[string]string{env.HeaderInstanceID: cred.AmsInstanceID},
+		Credentials: gatewayCredentials(cred, cfg),
 	}
 
 	return OPAConfig{
@@ -226,7 +344,247 @@ func (s *Supplier) createBundleGatewayConfig(cred *services.IASCredentials, cfg
 	}
 }
 
-func (s *Supplier) writeLaunchConfig(cfg env.Config) error {
+// gatewayCredentials authenticates OPA with the client certificate or, for bindings with a client secret, with the
+// client credentials grant of the identity binding.
+func gatewayCredentials(cred *services.IASCredentials, cfg tlsConfig) Credentials {
+	if cred.UsesClientSecret() {
+		return Credentials{OAuth2: &OAuth2{
+			GrantType: "client_credentials",
+			TokenURL:  cred.TokenURL,
+			ClientID:  cred.ClientID,
+		}}
+	}
+	return Credentials{ClientTLS: &ClientTLS{
+		Cert: cfg.CertPath,
+		Key:  cfg.KeyPath,
+	}}
+}
+
+// createDecisionLogsConfig configures the decision logs of AMS_DECISION_LOGS. The remote service is authenticated with
+// the same credentials as the bundle gateway.
+func (s *Supplier) createDecisionLogsConfig(cfg *OPAConfig, cred *services.IASCredentials, tlsCfg tlsConfig, logs env.DecisionLogs) error {
+	switch logs.Mode {
+	case env.DecisionLogsConsole:
+		cfg.DecisionLogs = &DecisionLogsConfig{Console: true}
+		s.Log.Info("logging authorization decisions to the console")
+	case env.DecisionLogsRemote:
+		cfg.Services[decisionLogsServiceKey] = OPARestConfig{
+			URL:         logs.URL,
+			Headers:     map[string]string{env.HeaderInstanceID: cred.AmsInstanceID},
+			Credentials: gatewayCredentials(cred, tlsCfg),
+		}
+		cfg.DecisionLogs = &DecisionLogsConfig{Service: decisionLogsServiceKey}
+		if logs.BufferSizeLimit > 0 || logs.UploadSizeLimit > 0 {
+			cfg.DecisionLogs.Reporting = &DecisionLogsReporting{}
+			if logs.BufferSizeLimit > 0 {
+				cfg.DecisionLogs.Reporting.BufferSizeLimitBytes = newInt64P(logs.BufferSizeLimit)
+			}
+			if logs.UploadSizeLimit > 0 {
+				cfg.DecisionLogs.Reporting.UploadSizeLimitBytes = newInt64P(logs.UploadSizeLimit)
+			}
+		}
+		s.Log.Info("uploading authorization decisions to %s", logs.URL)
+	default:
+		return nil
+	}
+	if len(logs.Mask) == 0 {
+		return nil
+	}
+	return writeDecisionLogMaskBundle(path.Join(s.Stager.DepDir(), decisionLogMaskBundle), logs.Mask)
+}
+
+// writeDecisionLogMaskBundle writes the mask policy as directory bundle with the root system/log.
+func writeDecisionLogMaskBundle(dir string, pointers []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create decision log mask bundle: %w", err)
+	}
+	manifest, err := json.Marshal(opabundle.Manifest{Roots: &[]string{decisionLogMaskRoot}})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path.Join(dir, ".manifest"), manifest, 0644); err != nil { //nolint
+		return fmt.Errorf("could not write decision log mask bundle: %w", err)
+	}
+	if err := os.WriteFile(path.Join(dir, "mask.rego"), decisionLogMask(pointers), 0644); err != nil { //nolint
+		return fmt.Errorf("could not write decision log mask bundle: %w", err)
+	}
+	return nil
+}
+
+// decisionLogMask returns the policy that masks the fields with the JSON pointers in the logged decisions.
+func decisionLogMask(pointers []string) []byte {
+	var b bytes.Buffer
+	b.WriteString("package system.log\n\n")
+	for _, ptr := range pointers {
+		quoted, _ := json.Marshal(ptr)
+		fmt.Fprintf(&b, "mask[%s]\n", quoted)
+	}
+	return b.Bytes()
+}
+
+// createObjectStoreService configures the bundle service to download the bundles directly from the S3 bucket of the
+// identity binding instead of the bundle gateway.
+func (s *Supplier) createObjectStoreService(cred *services.IASCredentials) (OPARestConfig, error) {
+	store := cred.AmsObjectStore
+	if store == nil {
+		return OPARestConfig{}, fmt.Errorf("AMS_BUNDLE_SOURCE=%s requires an identity binding with authorization_object_store credentials", env.BundleSourceObjectStore)
+	}
+	if err := validator.New().Struct(store); err != nil {
+		return OPARestConfig{}, fmt.Errorf("invalid authorization_object_store credentials: %w", err)
+	}
+	s.Log.Info("downloading bundles from object store bucket '%s' in region '%s'", store.Bucket, store.Region)
+	return OPARestConfig{
+		URL: store.BucketURL(),
+		Credentials: Credentials{S3Signing: &S3Signing{ProfileCredentials: &AWSProfileCredentials{
+			Path:    path.Join("/home/vcap/deps/", s.Stager.DepsIdx(), "aws_credentials"),
+			Profile: "default",
+			Region:  store.Region,
+		}}},
+	}, nil
+}
+
+// seedBundle copies the bundle file of the app to the persistence directory of OPA, so that it is activated at startup
+// until the first download succeeds. Relative paths are resolved against the app root.
+func (s *Supplier) seedBundle(instanceID, seed string) error {
+	if !path.IsAbs(seed) {
+		seed = path.Join(s.Stager.BuildDir(), seed)
+	}
+	f, err := os.Open(seed)
+	if err != nil {
+		return fmt.Errorf("could not open AMS_BUNDLE_SEED: %w", err)
+	}
+	defer f.Close()
+	if err := s.writePersistedBundle(instanceID, f); err != nil {
+		return err
+	}
+	s.Log.Info("seeded the persisted bundle of AMS instance '%s' with '%s'", instanceID, seed)
+	return nil
+}
+
+// writePersistedBundle writes the bundle where OPA stores the persisted bundle with the name of the AMS instance.
+func (s *Supplier) writePersistedBundle(instanceID string, r io.Reader) error {
+	dir := path.Join(s.Stager.DepDir(), opaPersistenceDir, "bundles", instanceID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create bundle persistence dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".bundle.tar.gz.*.tmp")
+	if err != nil {
+		return fmt.Errorf("could not create persisted bundle: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write persisted bundle: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("could not write persisted bundle: %w", err)
+	}
+	return os.Rename(tmp.Name(), path.Join(dir, "bundle.tar.gz"))
+}
+
+// prefetchTimeout limits the bundle download during staging.
+const prefetchTimeout = time.Minute
+
+// maxPrefetchBundleSize limits the size of the bundle downloaded during staging, so that a misbehaving bundle endpoint
+// cannot exhaust the memory of the staging container.
+const maxPrefetchBundleSize = 32 << 20
+
+// prefetchBundle downloads the bundle of the AMS instance from the bundle gateway and ships it as persisted bundle, so
+// that the sidecar serves it before its first download succeeds. Download failures are only logged, because the
+// sidecar downloads the bundle at startup anyway. A bundle that conflicts with the decision log mask fails the staging,
+// since OPA would never activate it.
+func (s *Supplier) prefetchBundle(creds *services.IASCredentials, tlsCfg tlsConfig, logs env.DecisionLogs) error {
+	raw, err := s.downloadBundle(creds, tlsCfg)
+	var b opabundle.Bundle
+	if err == nil {
+		b, err = readBundle(raw)
+	}
+	if err == nil && len(logs.Mask) > 0 && overlapsMaskRoot(b.Manifest) {
+		return fmt.Errorf("the roots %v of the bundle of AMS instance '%s' overlap the root '%s' of the decision log mask, OPA won't activate the bundle unless AMS_DECISION_LOGS_MASK is removed",
+			*b.Manifest.Roots, creds.AmsInstanceID, decisionLogMaskRoot)
+	}
+	if err == nil {
+		err = s.writePersistedBundle(creds.AmsInstanceID, bytes.NewReader(raw))
+	}
+	if err != nil {
+		s.Log.Warning("could not prefetch the bundle of AMS instance '%s', the AMS sidecar downloads it at startup: %s", creds.AmsInstanceID, err)
+		return nil
+	}
+	s.Log.Info("prefetched the bundle of AMS instance '%s' with revision '%s' (%d bytes)", creds.AmsInstanceID, b.Manifest.Revision, len(raw))
+	return nil
+}
+
+// overlapsMaskRoot reports whether the bundle with the manifest conflicts with the decision log mask bundle. A bundle
+// without roots owns the whole data tree.
+func overlapsMaskRoot(m opabundle.Manifest) bool {
+	m.Init()
+	for _, root := range *m.Roots {
+		if opabundle.RootPathsOverlap(root, decisionLogMaskRoot) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Supplier) downloadBundle(creds *services.IASCredentials, tlsCfg tlsConfig) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchTimeout)
+	defer cancel()
+	client, err := s.GetClient(tlsCfg.Cert, tlsCfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create AMS client: %w", err)
+	}
+	bundleURL, err := url.JoinPath(creds.AmsBundleGatewayURL, creds.AmsInstanceID+".tar.gz")
+	if err != nil {
+		return nil, fmt.Errorf("error building bundle url: %w", err)
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, bundleURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create bundle request: %w", err)
+	}
+	r.Header.Set(env.HeaderInstanceID, creds.AmsInstanceID)
+	r.Header.Set("User-Agent", fmt.Sprintf("cloud-authorization-buildpack/%s", s.BuildpackVersion))
+	if creds.UsesClientSecret() {
+		auth := &uploader.ClientCredentials{TokenURL: creds.TokenURL, ClientID: creds.ClientID, ClientSecret: creds.ClientSecret, Client: client}
+		token, err := auth.Token(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not get access token for bundle download: %w", err)
+		}
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("bundle request to %s failed: %w", bundleURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bundle request to %s returned status %s", bundleURL, resp.Status)
+	}
+	if resp.ContentLength > maxPrefetchBundleSize {
+		return nil, fmt.Errorf("bundle exceeds the maximum size of %d bytes", maxPrefetchBundleSize)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxPrefetchBundleSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not read bundle: %w", err)
+	}
+	if len(raw) > maxPrefetchBundleSize {
+		return nil, fmt.Errorf("bundle exceeds the maximum size of %d bytes", maxPrefetchBundleSize)
+	}
+	return raw, nil
+}
+
+// readBundle reads the bundle with the OPA bundle reader, which fails for archives that OPA cannot activate.
+func readBundle(raw []byte) (opabundle.Bundle, error) {
+	b, err := opabundle.NewCustomReader(opabundle.NewTarballLoaderWithBaseURL(bytes.NewReader(raw), "")).Read()
+	if err != nil {
+		return b, fmt.Errorf("invalid bundle: %w", err)
+	}
+	return b, nil
+}
+
+func (s *Supplier) writeLaunchConfig(cfg env.Config, creds *services.IASCredentials) error {
 	s.Log.Info("writing launch.yml..")
 	cmd := fmt.Sprintf(
 		`%q %q && %q run -s -c %q -l '%s' -a '127.0.0.1:%d' --disable-telemetry`,
@@ -236,6 +594,17 @@ func (s *Supplier) writeLaunchConfig(cfg env.Config) error {
 		path.Join("/home", "vcap", "deps", s.Stager.DepsIdx(), "opa_config.yml"),
 		cfg.LogLevel,
 		cfg.Port)
+	// cert-to-disk writes the client secret of the identity binding at startup
+	secretFile := path.Join("/home", "vcap", "deps", s.Stager.DepsIdx(), "ias.secret")
+	if creds.UsesClientSecret() && cfg.BundleSource == env.BundleSourceGateway {
+		cmd += fmt.Sprintf(` --set-file %q`, fmt.Sprintf(clientSecretConfigKey, bundleServiceKey)+"="+secretFile)
+	}
+	if creds.UsesClientSecret() && cfg.DecisionLogs.Mode == env.DecisionLogsRemote {
+		cmd += fmt.Sprintf(` --set-file %q`, fmt.Sprintf(clientSecretConfigKey, decisionLogsServiceKey)+"="+secretFile)
+	}
+	if len(cfg.DecisionLogs.Mask) > 0 {
+		cmd += fmt.Sprintf(` -b %q`, path.Join("/home", "vcap", "deps", s.Stager.DepsIdx(), decisionLogMaskBundle))
+	}
 	s.Log.Info("OPA start command: '%s'", cmd)
 	launchData := LaunchData{
 		[]Process{
@@ -275,22 +644,100 @@ func (s *Supplier) supplyCertCopier() error {
 	return os.Chmod(destFile, 0755)
 }
 
-func (s *Supplier) upload(creds *services.IASCredentials, tlsCfg tlsConfig, rootDir string) error {
-	client, err := s.GetClient(tlsCfg.Cert, tlsCfg.Key)
+func (s *Supplier) validateDCLs(roots []string, filter uploader.FileFilter, report *uploader.IssueReport, contextLines int) error {
+	existing := make([]string, 0, len(roots))
+	for _, root := range roots {
+		if _, err := os.Stat(root); err == nil { // a missing root is reported by the uploader
+			existing = append(existing, root)
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+	roots = existing
+	s.Log.Info("validating DCL syntax..")
+	issues, err := dcl.Validate(roots, filter)
 	if err != nil {
-		return fmt.Errorf("unable to create AMS client: %s", err)
+		return fmt.Errorf("could not validate DCLs: %w", err)
+	}
+	if len(issues) == 0 {
+		return nil
+	}
+	if err := report.Write(roots, issues); err != nil {
+		s.Log.Warning("could not write DCL issue report: %s", err)
+	}
+	uploader.IssuePrinter{Log: s.Log, Roots: roots, ContextLines: contextLines}.Print(issues)
+	if n := dcl.CountErrors(issues); n > 0 {
+		return fmt.Errorf("DCL validation failed with %d error(s)", n)
+	}
+	return nil
+}
+
+// issueReport returns the report for DCL issues, which is written to the deps dir or AMS_DCL_REPORT_DIR and
+// optionally to the app root.
+func (s *Supplier) issueReport(cfg env.Config) *uploader.IssueReport {
+	dir := s.Stager.DepDir()
+	if cfg.ReportDir != "" {
+		dir = cfg.ReportDir
+		if !path.IsAbs(dir) {
+			dir = path.Join(s.Stager.BuildDir(), dir)
+		}
+	}
+	report := &uploader.IssueReport{Dirs: []string{dir}, BaseDir: s.Stager.BuildDir()}
+	if cfg.ReportInBuildDir {
+		report.Dirs = append(report.Dirs, s.Stager.BuildDir())
+	}
+	return report
+}
+
+func (s *Supplier) upload(creds *services.IASCredentials, tlsCfg tlsConfig, cfg env.Config) error {
+	roots := make([]string, 0, len(cfg.Roots))
+	for _, root := range cfg.Roots {
+		roots = append(roots, path.Join(s.Stager.BuildDir(), root))
+	}
+	filter := uploader.FileFilter{Include: cfg.Include, Exclude: cfg.Exclude}
+	report := s.issueReport(cfg)
+	if cfg.ValidateDCL {
+		if err := s.validateDCLs(roots, filter, report, cfg.ContextLines); err != nil {
+			return err
+		}
 	}
 	vcapApp := env.LoadVcapApplication(s.Log)
+	retry := uploader.DefaultRetryPolicy
+	retry.Timeout = cfg.UploadTimeout
 
 	u := uploader.Uploader{
-		Log:           s.Log,
-		Root:          path.Join(s.Stager.BuildDir(), rootDir),
-		Client:        client,
-		AMSInstanceID: creds.AmsInstanceID,
+		Log:            s.Log,
+		Roots:          roots,
+		Filter:         filter,
+		MaxArchiveSize: cfg.MaxArchiveSize,
+		AMSInstanceID:  creds.AmsInstanceID,
 		ExtraHeaders: map[string]string{
 			"User-Agent": fmt.Sprintf("cloud-authorization-buildpack/%s", s.BuildpackVersion),
 			"X-Appname":  vcapApp.ApplicationName,
 		},
+		CacheDir:     s.Stager.CacheDir(),
+		ForceUpload:  cfg.ForceUpload,
+		Retry:        retry,
+		Report:       report,
+		ContextLines: cfg.ContextLines,
+	}
+	if cfg.DryRun {
+		return u.DryRun(creds.AmsServerURL, s.Stager.DepDir())
+	}
+
+	client, err := s.GetClient(tlsCfg.Cert, tlsCfg.Key)
+	if err != nil {
+		return fmt.Errorf("unable to create AMS client: %s", err)
+	}
+	u.Client = client
+	if creds.UsesClientSecret() {
+		u.Auth = &uploader.ClientCredentials{
+			TokenURL:     creds.TokenURL,
+			ClientID:     creds.ClientID,
+			ClientSecret: creds.ClientSecret,
+			Client:       client,
+		}
 	}
 	return u.Do(context.Background(), creds.AmsServerURL)
 }
@@ -4,14 +4,18 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,9 +24,18 @@ import (
 	"github.com/golang/mock/gomock"
 	. "github.com/onsi/ginkgo" //nolint
 	. "github.com/onsi/gomega" //nolint
+	"github.com/open-policy-agent/opa/ast"
+	opabundle "github.com/open-policy-agent/opa/bundle"
 	"github.com/open-policy-agent/opa/config"
+	"github.com/open-policy-agent/opa/download"
+	"github.com/open-policy-agent/opa/loader"
+	"github.com/open-policy-agent/opa/metrics"
 	"github.com/open-policy-agent/opa/plugins/bundle"
+	"github.com/open-policy-agent/opa/plugins/logs"
 	"github.com/open-policy-agent/opa/plugins/rest"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
 	"gopkg.in/yaml.v2"
 
 	"github.com/SAP/cloud-authorization-buildpack/pkg/supply/env"
@@ -38,6 +51,7 @@ var _ = Describe("Supply", func() {
 		certSpy, keySpy []byte
 		err             error
 		buildDir        string
+		cacheDir        string
 		depsDir         string
 		depsIdx         string
 		depDir          string
@@ -51,10 +65,13 @@ var _ = Describe("Supply", func() {
 	)
 
 	BeforeEach(func() {
+		uploadReqSpy = nil
 		depsDir, err = os.MkdirTemp("", "test")
 		Expect(err).To(BeNil())
 		buildDir, err = os.MkdirTemp("", "buildDir")
 		Expect(err).To(BeNil())
+		cacheDir, err = os.MkdirTemp("", "cacheDir")
+		Expect(err).To(BeNil())
 		certCopierDir, err = os.MkdirTemp("", "certCopierDir")
 		Expect(err).To(BeNil())
 		err := os.WriteFile(path.Join(certCopierDir, "cert-to-disk"), []byte("dummy file"), 0755) //nolint
@@ -74,7 +91,7 @@ var _ = Describe("Supply", func() {
 		mockCtrl = gomock.NewController(GinkgoT())
 		mockAMSClient = NewMockAMSClient(mockCtrl)
 		mockAMSClient.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
-			uploadReqSpy = req
+			uploadReqSpy = spyRequest(req)
 			return &http.Response{StatusCode: 200, Body: io.NopCloser(nil)}, nil
 		}).AnyTimes()
 	})
@@ -86,7 +103,7 @@ var _ = Describe("Supply", func() {
 		Expect(err).NotTo(HaveOccurred())
 		buildpackDir := path.Join(filepath.Dir(filepath.Dir(wd)))
 
-		args := []string{buildDir, "", depsDir, depsIdx}
+		args := []string{buildDir, cacheDir, depsDir, depsIdx}
 		bps := libbuildpack.NewStager(args, logger, &libbuildpack.Manifest{})
 		m, err := libbuildpack.NewManifest(buildpackDir, logger, time.Now())
 		Expect(err).NotTo(HaveOccurred())
@@ -111,6 +128,7 @@ var _ = Describe("Supply", func() {
 
 		err = os.RemoveAll(depsDir)
 		Expect(err).To(BeNil())
+		Expect(os.RemoveAll(cacheDir)).To(Succeed())
 		Expect(os.Unsetenv("VCAP_APPLICATION")).To(Succeed())
 		Expect(os.Unsetenv("AMS_DCL_ROOT")).To(Succeed())
 		Expect(os.Unsetenv("AMS_SERVICE")).To(Succeed())
@@ -118,14 +136,83 @@ var _ = Describe("Supply", func() {
 		Expect(os.Unsetenv("VCAP_SERVICES")).To(Succeed())
 	})
 	When("AMS credentials are included in the IAS credentials", func() {
-		Context("and credential type is not x509", func() {
+		Context("and the binding contains a client secret instead of a certificate", func() {
+			var tokenReqSpy *http.Request
 			BeforeEach(func() {
 				vcapServices = testdata.EnvWithIASAuthWithClientSecret
 				os.Setenv("AMS_DCL_ROOT", "/policies")
+				tokenReqSpy = nil
+				mockAMSClient = NewMockAMSClient(mockCtrl)
+				gomock.InOrder(
+					mockAMSClient.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+						tokenReqSpy = spyRequest(req)
+						return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(`{"access_token":"my-token","token_type":"bearer","expires_in":3600}`))}, nil
+					}),
+					mockAMSClient.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+						uploadReqSpy = spyRequest(req)
+						return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(""))}, nil
+					}))
 			})
-			It("should fail", func() {
-				err := supplier.Run()
-				Expect(err).To(HaveOccurred())
+			It("uploads the policies with an access token of the identity client", func() {
+				Expect(supplier.Run()).To(Succeed())
+				Expect(certSpy).To(BeEmpty())
+				Expect(keySpy).To(BeEmpty())
+
+				Expect(tokenReqSpy.URL.String()).To(Equal("https://mytenant.accounts400.ondemand.com/oauth2/token"))
+				clientID, secret, ok := tokenReqSpy.BasicAuth()
+				Expect(ok).To(BeTrue())
+				Expect(clientID).To(Equal("601AED1D-0063-4B5B-8FCE-06FC75AF957C"))
+				Expect(secret).To(Equal("mysecret"))
+				body, err := io.ReadAll(tokenReqSpy.Body)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(body)).To(ContainSubstring("grant_type=client_credentials"))
+
+				Expect(uploadReqSpy.URL.String()).To(Equal("https://mytenant.accounts400.ondemand.com/sap/ams/v1/ams-instances/847bf93c-3b4d-4c41-9e5b-9aee7bfa6348/dcl-upload"))
+				Expect(uploadReqSpy.Header.Get("Authorization")).To(Equal("Bearer my-token"))
+				Expect(writtenLogs.String()).To(ContainSubstring("using the client secret of identity client '601AED1D-0063-4B5B-8FCE-06FC75AF957C'"))
+				Expect(writtenLogs.String()).NotTo(ContainSubstring("mysecret"))
+			})
+			It("configures OPA to download bundles with the client credentials grant", func() {
+				Expect(supplier.Run()).To(Succeed())
+				rawConfig, err := os.ReadFile(filepath.Join(depDir, "opa_config.yml"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(rawConfig)).NotTo(ContainSubstring("mysecret"))
+				cfg, err := config.ParseConfig(rawConfig, "testId")
+				Expect(err).NotTo(HaveOccurred())
+
+				var restConfig map[string]rest.Config
+				Expect(json.Unmarshal(cfg.Services, &restConfig)).To(Succeed())
+				Expect(restConfig).To(HaveKey("bundle_storage"))
+				svc := restConfig["bundle_storage"]
+				By("specifying OAuth2 instead of ClientTLS", func() {
+					Expect(svc.Credentials.ClientTLS).To(BeNil())
+					Expect(svc.Credentials.OAuth2).NotTo(BeNil())
+					Expect(svc.Credentials.OAuth2.GrantType).To(Equal("client_credentials"))
+					Expect(svc.Credentials.OAuth2.TokenURL).To(Equal("https://mytenant.accounts400.ondemand.com/oauth2/token"))
+					Expect(svc.Credentials.OAuth2.ClientID).To(Equal("601AED1D-0063-4B5B-8FCE-06FC75AF957C"))
+					Expect(svc.URL).To(Equal("https://mytenant.accounts400.ondemand.com/sap/ams/v1/bundles"))
+				})
+				By("being accepted by OPA once the client secret is set by the start command", func() {
+					svc.Credentials.OAuth2.ClientSecret = "mysecret"
+					rawSvc, err := json.Marshal(svc)
+					Expect(err).NotTo(HaveOccurred())
+					client, err := rest.New(rawSvc, nil)
+					Expect(err).NotTo(HaveOccurred())
+					plugin, err := client.Config().AuthPlugin(client.AuthPluginLookup())
+					Expect(err).NotTo(HaveOccurred())
+					_, err = plugin.NewClient(*client.Config())
+					Expect(err).NotTo(HaveOccurred())
+				})
+			})
+			It("reads the client secret from the file written by cert-to-disk", func() {
+				Expect(supplier.Run()).To(Succeed())
+				launchConfig, err := os.Open(filepath.Join(depDir, "launch.yml"))
+				Expect(err).NotTo(HaveOccurred())
+				defer launchConfig.Close()
+				var ld supply.LaunchData
+				Expect(yaml.NewDecoder(launchConfig).Decode(&ld)).To(Succeed())
+				Expect(ld.Processes).To(HaveLen(1))
+				Expect(ld.Processes[0].Command).To(HaveSuffix(`--disable-telemetry --set-file "services.bundle_storage.credentials.oauth2.client_secret=/home/vcap/deps/42/ias.secret"`))
 			})
 		})
 		Context("and VCAP_SERVICES contains user-provided 'megaclite' service instance from DwC", func() {
@@ -154,6 +241,53 @@ var _ = Describe("Supply", func() {
 				})
 			})
 		})
+		Context("and credential type is X509_PROVIDED", func() {
+			BeforeEach(func() {
+				vcapServices = testdata.EnvWithIASAuthX509Provided
+				os.Setenv("AMS_DCL_ROOT", "/policies")
+			})
+			AfterEach(func() {
+				os.Unsetenv("AMS_IDENTITY_KEY_FILE")
+			})
+			It("should fail without a private key", func() {
+				err := supplier.Run()
+				Expect(err).To(MatchError(ContainSubstring("provide the private key of the certificate in AMS_IDENTITY_KEY_FILE or AMS_IDENTITY_KEY")))
+			})
+			It("should upload with the private key from AMS_IDENTITY_KEY_FILE relative to the app root", func() {
+				Expect(os.WriteFile(filepath.Join(buildDir, "ias.key"), []byte(testdata.ProvidedKey), 0600)).To(Succeed())
+				os.Setenv("AMS_IDENTITY_KEY_FILE", "ias.key")
+				Expect(supplier.Run()).To(Succeed())
+				Expect(string(certSpy)).To(Equal(testdata.ProvidedCert))
+				Expect(string(keySpy)).To(Equal(testdata.ProvidedKey))
+			})
+		})
+		Context("and several identity services are bound", func() {
+			BeforeEach(func() {
+				vcapServices = testdata.EnvWithMultipleIAS
+				os.Setenv("AMS_DCL_ROOT", "/policies")
+			})
+			AfterEach(func() {
+				os.Unsetenv("AMS_IDENTITY_SERVICE_NAME")
+			})
+			It("should fail listing all candidates", func() {
+				err := supplier.Run()
+				Expect(err).To(MatchError(ContainSubstring("set AMS_IDENTITY_SERVICE_NAME")))
+				Expect(err.Error()).To(ContainSubstring("'ias-ams-node' (type identity, instance name 'ias-ams-node', tags [])"))
+				Expect(err.Error()).To(ContainSubstring("'ias-login-binding' (type identity, instance name 'ias-login', tags [login])"))
+			})
+			It("should use the service selected by AMS_IDENTITY_SERVICE_NAME", func() {
+				os.Setenv("AMS_IDENTITY_SERVICE_NAME", "login")
+				Expect(supplier.Run()).To(Succeed())
+				Expect(uploadReqSpy.Header.Get(env.HeaderInstanceID)).To(Equal("11111111-3b4d-4c41-9e5b-9aee7bfa6348"))
+				Expect(writtenLogs.String()).To(ContainSubstring(`Selected 'identity' service 'ias-login-binding' via AMS_IDENTITY_SERVICE_NAME="login"`))
+			})
+			It("should explain why no service matches AMS_IDENTITY_SERVICE_NAME", func() {
+				os.Setenv("AMS_IDENTITY_SERVICE_NAME", "unknown")
+				err := supplier.Run()
+				Expect(err).To(MatchError(ContainSubstring(`none of the 2 identity service(s) matches AMS_IDENTITY_SERVICE_NAME="unknown"`)))
+				Expect(err.Error()).To(ContainSubstring("neither name, instance name nor tags match"))
+			})
+		})
 		Context("and credential type is x509", func() {
 			BeforeEach(func() {
 				vcapServices = testdata.EnvWithIASAuthX509
@@ -163,14 +297,19 @@ var _ = Describe("Supply", func() {
 			It("should succeed", func() {
 				Expect(supplier.Run()).To(Succeed())
 				Expect(filepath.Join(depDir, "launch.yml")).To(BeARegularFile())
-				Expect(string(keySpy)).To(Equal("identity-key-payload"))
-				Expect(string(certSpy)).To(Equal("identity-cert-payload"))
+				Expect(string(keySpy)).To(Equal(testdata.IdentityKey))
+				Expect(string(certSpy)).To(Equal(testdata.IdentityCert))
 			})
 			It("sets the ams instance id http header when uploading the bundle", func() {
 				Expect(supplier.Run()).To(Succeed())
 				expectedValue := []string{"00000000-3b4d-4c41-9e5b-9aee7bfa6348"}
 				Expect(uploadReqSpy.Header).Should(HaveKeyWithValue(env.HeaderInstanceID, expectedValue))
 			})
+			It("sets the digest of the policy archive as upload header", func() {
+				Expect(supplier.Run()).To(Succeed())
+				Expect(uploadReqSpy.Header.Get(env.HeaderDCLDigest)).To(MatchRegexp("^sha256:[0-9a-f]{64}$"))
+				Expect(writtenLogs.String()).To(ContainSubstring("policy archive digest: " + uploadReqSpy.Header.Get(env.HeaderDCLDigest)))
+			})
 			It("sets the buildpack version as User-Agent Header", func() {
 				Expect(supplier.Run()).To(Succeed())
 				expectedValue := []string{"cloud-authorization-buildpack/UNIT-TEST"}
@@ -266,6 +405,8 @@ var _ = Describe("Supply", func() {
 				Expect(err).NotTo(HaveOccurred())
 				expectIsExecutable(path.Join(buildDir, ".profile.d", "0000_opa_env.sh"))
 				Expect(string(env)).To(ContainSubstring(`export OPA_URL=http://127.0.0.1:9888`))
+				Expect(string(env)).To(ContainSubstring(`export AMS_VALUE_HELP_CERT_ISSUER='{"Country":["DE"],"Organization":["SAP SE"],"Locality":["Walldorf"],"CommonName":"SAP Cloud Root CA"}'`))
+				Expect(string(env)).To(ContainSubstring(`export AMS_VALUE_HELP_CERT_SUBJECT='{"Country":["DE"],"Organization":["SAP SE"],"OrganizationalUnit":["SAP Cloud Platform Clients","Canary","someuid"],"Locality":["AMS"],"CommonName":"ValueHelpmTLSCert"}'`))
 			})
 			It("provides the OPA executable", func() {
 				Expect(supplier.Run()).To(Succeed())
@@ -292,6 +433,159 @@ var _ = Describe("Supply", func() {
 					Expect(writtenLogs.String()).To(ContainSubstring("upload no authorization data"))
 				})
 			})
+			When("the policies have been uploaded before", func() {
+				JustBeforeEach(func() {
+					Expect(supplier.Run()).To(Succeed())
+					uploadReqSpy = nil
+				})
+				It("skips the upload if nothing changed", func() {
+					Expect(supplier.Run()).To(Succeed())
+					Expect(uploadReqSpy).To(BeNil())
+					Expect(writtenLogs.String()).To(ContainSubstring("skipping policy upload: archive is unchanged since the last successful upload to AMS instance '00000000-3b4d-4c41-9e5b-9aee7bfa6348'"))
+				})
+				It("uploads changed policies", func() {
+					Expect(os.WriteFile(path.Join(buildDir, "policies", "myPolicies0", "policy0.dcl"), []byte("POLICY changed {\n\tGRANT read ON x;\n}"), 0600)).To(Succeed())
+					Expect(supplier.Run()).To(Succeed())
+					Expect(uploadReqSpy).NotTo(BeNil())
+					Expect(writtenLogs.String()).To(ContainSubstring("uploading policies: archive changed since the last upload"))
+				})
+				It("uploads unchanged policies if AMS_FORCE_UPLOAD is set", func() {
+					os.Setenv("AMS_FORCE_UPLOAD", "true")
+					defer os.Unsetenv("AMS_FORCE_UPLOAD")
+					Expect(supplier.Run()).To(Succeed())
+					Expect(uploadReqSpy).NotTo(BeNil())
+					Expect(writtenLogs.String()).To(ContainSubstring("uploading policies: AMS_FORCE_UPLOAD is set"))
+				})
+			})
+			It("does not record failed uploads in the staging cache", func() {
+				mockAMSClient = NewMockAMSClient(mockCtrl)
+				mockAMSClient.EXPECT().Do(gomock.Any()).Return(&http.Response{StatusCode: 400, Body: io.NopCloser(strings.NewReader(""))}, nil)
+				Expect(supplier.Run()).NotTo(Succeed())
+				Expect(filepath.Join(cacheDir, "ams-dcl-upload", "00000000-3b4d-4c41-9e5b-9aee7bfa6348.digest")).NotTo(BeAnExistingFile())
+			})
+			It("summarizes files that are not matched by the include patterns", func() {
+				Expect(supplier.Run()).To(Succeed())
+				Expect(writtenLogs.String()).To(ContainSubstring("file(s) in policy upload archive that are not matched by the include patterns"))
+				Expect(writtenLogs.String()).NotTo(ContainSubstring("skipping 'myPolicies0/data.json'"))
+			})
+			When("AMS_UPLOAD_DRY_RUN is set", func() {
+				BeforeEach(func() { os.Setenv("AMS_UPLOAD_DRY_RUN", "true") })
+				AfterEach(func() { os.Unsetenv("AMS_UPLOAD_DRY_RUN") })
+				It("writes the archive and a manifest instead of uploading", func() {
+					Expect(supplier.Run()).To(Succeed())
+					Expect(uploadReqSpy).To(BeNil())
+
+					archive, err := os.Open(filepath.Join(depDir, uploader.DryRunArchiveFile))
+					Expect(err).NotTo(HaveOccurred())
+					defer archive.Close()
+					Expect(getTgzFileNames(archive)).To(ConsistOf("myPolicies0/policy0.dcl", "myPolicies1/policy1.dcl", "schema.dcl"))
+
+					var manifest uploader.DryRunManifest
+					Expect(libbuildpack.NewJSON().Load(filepath.Join(depDir, uploader.DryRunManifestFile), &manifest)).To(Succeed())
+					Expect(manifest.URL).To(Equal("https://mytenant.accounts400.ondemand.com/sap/ams/v1/ams-instances/00000000-3b4d-4c41-9e5b-9aee7bfa6348/dcl-upload"))
+					Expect(manifest.Headers).To(HaveKeyWithValue(env.HeaderInstanceID, "00000000-3b4d-4c41-9e5b-9aee7bfa6348"))
+					Expect(manifest.Headers).To(HaveKeyWithValue("User-Agent", "cloud-authorization-buildpack/UNIT-TEST"))
+					Expect(manifest.Headers).To(HaveKeyWithValue(env.HeaderDCLDigest, manifest.Archive.Digest))
+					Expect(manifest.Archive.File).To(Equal(uploader.DryRunArchiveFile))
+					Expect(manifest.Files).To(HaveLen(3))
+					Expect(manifest.Files[0].Name).To(Equal("myPolicies0/policy0.dcl"))
+					Expect(manifest.Files[0].Digest).To(HavePrefix("sha256:"))
+					Expect(writtenLogs.String()).To(ContainSubstring("dry run: skipping policy upload"))
+				})
+			})
+			When("AMS_DCL_ROOT lists several roots", func() {
+				BeforeEach(func() {
+					Expect(os.MkdirAll(path.Join(buildDir, "module2", "extra"), os.ModePerm)).To(Succeed())
+					Expect(os.WriteFile(path.Join(buildDir, "module2", "extra", "extra.dcl"), []byte("POLICY extra {\n\tGRANT read ON x;\n}"), 0600)).To(Succeed())
+					os.Setenv("AMS_DCL_ROOT", "/policies, /module2")
+				})
+				It("uploads the merged roots in one archive", func() {
+					Expect(supplier.Run()).To(Succeed())
+					files := getTgzFileNames(uploadReqSpy.Body)
+					Expect(files).To(ConsistOf("myPolicies0/policy0.dcl", "myPolicies1/policy1.dcl", "schema.dcl", "extra/extra.dcl"))
+				})
+				It("fails on conflicting paths", func() {
+					Expect(os.WriteFile(path.Join(buildDir, "module2", "schema.dcl"), []byte("SCHEMA {}"), 0600)).To(Succeed())
+					err := supplier.Run()
+					Expect(err).To(MatchError(ContainSubstring("conflicting paths in DCL roots: 'schema.dcl' exists in")))
+					Expect(uploadReqSpy).To(BeNil())
+				})
+				It("validates the existing roots if another root is missing", func() {
+					os.Setenv("AMS_DCL_ROOT", "/policies, /module2, /missing")
+					Expect(os.WriteFile(path.Join(buildDir, "module2", "broken.dcl"), []byte("POLICY broken {\n\tGRANT read salesOrder;\n}"), 0600)).To(Succeed())
+					err := supplier.Run()
+					Expect(err).To(MatchError(ContainSubstring("DCL validation failed with 1 error(s)")))
+					Expect(uploadReqSpy).To(BeNil())
+				})
+			})
+			When("the policy archive exceeds AMS_DCL_MAX_ARCHIVE_SIZE", func() {
+				BeforeEach(func() { os.Setenv("AMS_DCL_MAX_ARCHIVE_SIZE", "100") })
+				AfterEach(func() { os.Unsetenv("AMS_DCL_MAX_ARCHIVE_SIZE") })
+				It("fails with a readable error", func() {
+					err := supplier.Run()
+					Expect(err).To(MatchError(ContainSubstring("exceeds the maximum size of 100 bytes")))
+					Expect(uploadReqSpy).To(BeNil())
+				})
+			})
+			When("AMS_DCL_INCLUDE and AMS_DCL_EXCLUDE are set", func() {
+				BeforeEach(func() {
+					os.Setenv("AMS_DCL_INCLUDE", "*.dcl, *.json")
+					os.Setenv("AMS_DCL_EXCLUDE", "myPolicies1")
+				})
+				AfterEach(func() {
+					os.Unsetenv("AMS_DCL_INCLUDE")
+					os.Unsetenv("AMS_DCL_EXCLUDE")
+				})
+				It("uploads the matching files", func() {
+					Expect(supplier.Run()).To(Succeed())
+					files := getTgzFileNames(uploadReqSpy.Body)
+					Expect(files).To(ConsistOf("myPolicies0/data.json", "myPolicies0/policy0.dcl", "schema.dcl"))
+				})
+			})
+			When("a DCL file contains a syntax error", func() {
+				BeforeEach(func() {
+					Expect(os.WriteFile(path.Join(buildDir, "policies", "broken.dcl"), []byte("POLICY broken {\n\tGRANT read salesOrder;\n}"), 0600)).To(Succeed())
+				})
+				It("fails before uploading", func() {
+					err := supplier.Run()
+					Expect(err).To(MatchError(ContainSubstring("DCL validation failed with 1 error(s)")))
+					Expect(writtenLogs.String()).To(ContainSubstring("Syntax Error in broken.dcl line 2"))
+					Expect(writtenLogs.String()).NotTo(ContainSubstring("creating policy archive"))
+				})
+				It("writes SARIF and JUnit reports to the deps dir", func() {
+					Expect(supplier.Run()).NotTo(Succeed())
+					sarif, err := os.ReadFile(filepath.Join(depDir, uploader.SARIFReportFile))
+					Expect(err).NotTo(HaveOccurred())
+					Expect(string(sarif)).To(ContainSubstring(`"uri": "policies/broken.dcl"`))
+					Expect(string(sarif)).To(ContainSubstring(`"startLine": 2`))
+					Expect(filepath.Join(depDir, uploader.JUnitReportFile)).To(BeAnExistingFile())
+					Expect(filepath.Join(buildDir, uploader.SARIFReportFile)).NotTo(BeAnExistingFile())
+				})
+				When("AMS_DCL_REPORT_DIR and AMS_DCL_REPORT_IN_BUILD_DIR are set", func() {
+					BeforeEach(func() {
+						os.Setenv("AMS_DCL_REPORT_DIR", "reports")
+						os.Setenv("AMS_DCL_REPORT_IN_BUILD_DIR", "true")
+					})
+					AfterEach(func() {
+						os.Unsetenv("AMS_DCL_REPORT_DIR")
+						os.Unsetenv("AMS_DCL_REPORT_IN_BUILD_DIR")
+					})
+					It("writes the reports to the configured directories", func() {
+						Expect(supplier.Run()).NotTo(Succeed())
+						Expect(filepath.Join(buildDir, "reports", uploader.SARIFReportFile)).To(BeAnExistingFile())
+						Expect(filepath.Join(buildDir, uploader.JUnitReportFile)).To(BeAnExistingFile())
+						Expect(filepath.Join(depDir, uploader.SARIFReportFile)).NotTo(BeAnExistingFile())
+					})
+				})
+				When("AMS_DCL_VALIDATE is false", func() {
+					BeforeEach(func() { os.Setenv("AMS_DCL_VALIDATE", "false") })
+					AfterEach(func() { os.Unsetenv("AMS_DCL_VALIDATE") })
+					It("leaves the validation to the AMS server", func() {
+						Expect(supplier.Run()).To(Succeed())
+						Expect(getTgzFileNames(uploadReqSpy.Body)).To(ContainElement("broken.dcl"))
+					})
+				})
+			})
 			When("AMS_DATA is set", func() {
 				BeforeEach(func() {
 					os.Setenv("AMS_DATA", "{\"root\":\"/policies\"}")
@@ -316,7 +610,7 @@ var _ = Describe("Supply", func() {
 					BeforeEach(func() {
 						mockAMSClient = NewMockAMSClient(mockCtrl)
 						mockAMSClient.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
-							uploadReqSpy = req
+							uploadReqSpy = spyRequest(req)
 							return &http.Response{StatusCode: 400, Body: io.NopCloser(strings.NewReader("your policy is broken"))}, nil
 						}).AnyTimes()
 
@@ -327,23 +621,66 @@ var _ = Describe("Supply", func() {
 						Expect(err.Error()).To(ContainSubstring("your policy is broken"))
 					})
 				})
+				Context("400 with DCL compile errors", func() {
+					BeforeEach(func() {
+						mockAMSClient = NewMockAMSClient(mockCtrl)
+						body := `{"compile_error":{"dclIssues":{"myPolicies0/policy0.dcl":[{"line":1,"column":8,"message":"unknown attribute","severity":"ERROR","code":12}]}}}`
+						mockAMSClient.EXPECT().Do(gomock.Any()).Return(&http.Response{StatusCode: 400, Body: io.NopCloser(strings.NewReader(body))}, nil)
+					})
+					It("writes the issues to the reports", func() {
+						Expect(supplier.Run()).NotTo(Succeed())
+						sarif, err := os.ReadFile(filepath.Join(depDir, uploader.SARIFReportFile))
+						Expect(err).NotTo(HaveOccurred())
+						Expect(string(sarif)).To(ContainSubstring(`"uri": "policies/myPolicies0/policy0.dcl"`))
+						Expect(string(sarif)).To(ContainSubstring(`"ruleId": "DCL12"`))
+						Expect(writtenLogs.String()).To(ContainSubstring("ERROR in myPolicies0/policy0.dcl line 1: unknown attribute"))
+						Expect(writtenLogs.String()).To(MatchRegexp(`> 1 \| \S`))
+						Expect(writtenLogs.String()).To(ContainSubstring("found 1 error(s) and 0 warning(s) in 1 file(s)"))
+					})
+				})
 				Context("401 (proof-token endpoint not ready)", func() {
+					var defaultRetryPolicy uploader.RetryPolicy
 					BeforeEach(func() {
-						uploader.RetryPeriod = time.Millisecond * 10
+						defaultRetryPolicy = uploader.DefaultRetryPolicy
+						uploader.DefaultRetryPolicy.InitialBackoff = time.Millisecond * 10
 						mockAMSClient = NewMockAMSClient(mockCtrl)
 						gomock.InOrder(
 							mockAMSClient.EXPECT().Do(gomock.Any()).Return(&http.Response{StatusCode: 401, Body: io.NopCloser(strings.NewReader("could not find certificate"))}, nil),
 							mockAMSClient.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
-								uploadReqSpy = req
+								uploadReqSpy = spyRequest(req)
 								return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(""))}, nil
 							}))
 					})
+					AfterEach(func() {
+						uploader.DefaultRetryPolicy = defaultRetryPolicy
+					})
 					It("retries", func() {
 						Expect(supplier.Run()).To(Succeed())
 						Expect(writtenLogs.String()).To(ContainSubstring("retrying after"))
 						Expect(uploadReqSpy.Body).NotTo(BeNil())
 					})
 				})
+				Context("503 with Retry-After exceeding AMS_UPLOAD_TIMEOUT", func() {
+					BeforeEach(func() {
+						os.Setenv("AMS_UPLOAD_TIMEOUT", "1s")
+						mockAMSClient = NewMockAMSClient(mockCtrl)
+						mockAMSClient.EXPECT().Do(gomock.Any()).Return(&http.Response{
+							StatusCode: 503,
+							Status:     "503 Service Unavailable",
+							Header:     http.Header{"Retry-After": []string{"120"}},
+							Body:       io.NopCloser(strings.NewReader("maintenance")),
+						}, nil)
+					})
+					AfterEach(func() {
+						os.Unsetenv("AMS_UPLOAD_TIMEOUT")
+					})
+					It("gives up without waiting", func() {
+						err := supplier.Run()
+						Expect(err).To(HaveOccurred())
+						Expect(err.Error()).To(ContainSubstring("maintenance"))
+						Expect(writtenLogs.String()).To(ContainSubstring("giving up DCL upload after 1 attempt(s)"))
+					})
+				})
 			})
 			When("AMS_LOG_LEVEL is set to info", func() {
 				BeforeEach(func() { os.Setenv("AMS_LOG_LEVEL", "info") })
@@ -374,6 +711,499 @@ var _ = Describe("Supply", func() {
 		JustBeforeEach(func() {
 			os.Unsetenv("VCAP_SERVICES")
 		})
+		It("should abort with err", func() {
+			err := supplier.Run()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("cannot find authorization-enabled identity service"))
+			Expect(err.Error()).To(ContainSubstring("identity: skipped (neither VCAP_SERVICES nor VCAP_SERVICES_FILE_PATH is set)"))
+		})
+	})
+	When("AMS_BUNDLE_SOURCE is object-store", func() {
+		var (
+			objectStore         *httptest.Server
+			objectStoreRequests []*http.Request
+		)
+		BeforeEach(func() {
+			objectStoreRequests = nil
+			objectStore = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				objectStoreRequests = append(objectStoreRequests, r)
+				w.WriteHeader(http.StatusOK)
+			}))
+			vcapServices = strings.ReplaceAll(testdata.EnvWithIASAuthX509, `"s3-eu-central-1.amazonaws.com"`, strconv.Quote(objectStore.URL))
+			os.Setenv("AMS_DCL_ROOT", "/policies")
+			os.Setenv("AMS_BUNDLE_SOURCE", "object-store")
+		})
+		AfterEach(func() {
+			objectStore.Close()
+			os.Unsetenv("AMS_BUNDLE_SOURCE")
+		})
+		It("configures OPA to download the bundles from the bucket with S3 signing", func() {
+			Expect(supplier.Run()).To(Succeed())
+			rawConfig, err := os.ReadFile(filepath.Join(depDir, "opa_config.yml"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(rawConfig)).NotTo(ContainSubstring("mysecretaccesskey"))
+			cfg, err := config.ParseConfig(rawConfig, "testId")
+			Expect(err).NotTo(HaveOccurred())
+
+			var restConfig map[string]rest.Config
+			Expect(json.Unmarshal(cfg.Services, &restConfig)).To(Succeed())
+			svc := restConfig["bundle_storage"]
+			By("specifying the bucket and S3 signing", func() {
+				Expect(svc.URL).To(Equal(objectStore.URL + "/my-bucket"))
+				Expect(svc.Credentials.ClientTLS).To(BeNil())
+				Expect(svc.Credentials.S3Signing).NotTo(BeNil())
+				Expect(svc.Credentials.S3Signing.AWSProfileCredentials.Path).To(Equal("/home/vcap/deps/42/aws_credentials"))
+				Expect(svc.Credentials.S3Signing.AWSProfileCredentials.RegionName).To(Equal("eu-central-1"))
+			})
+			By("downloading a bundle from the object store with signed requests", func() {
+				credentialsFile := filepath.Join(depDir, "aws_credentials")
+				Expect(os.WriteFile(credentialsFile, []byte("[default]\naws_access_key_id = myawstestaccesskeyid\naws_secret_access_key = mysecretaccesskey\n"), 0600)).To(Succeed())
+				svc.Credentials.S3Signing.AWSProfileCredentials.Path = credentialsFile
+				rawSvc, err := json.Marshal(svc)
+				Expect(err).NotTo(HaveOccurred())
+				client, err := rest.New(rawSvc, nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				resp, err := client.Do(context.Background(), http.MethodGet, "00000000-3b4d-4c41-9e5b-9aee7bfa6348.tar.gz")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.Body.Close()).To(Succeed())
+				Expect(objectStoreRequests).To(HaveLen(1))
+				Expect(objectStoreRequests[0].URL.Path).To(Equal("/my-bucket/00000000-3b4d-4c41-9e5b-9aee7bfa6348.tar.gz"))
+				Expect(objectStoreRequests[0].Header.Get("Authorization")).To(HavePrefix("AWS4-HMAC-SHA256 Credential=myawstestaccesskeyid/"))
+				Expect(objectStoreRequests[0].Header.Get("Authorization")).To(ContainSubstring("/eu-central-1/s3/aws4_request"))
+			})
+		})
+		It("fails if the identity binding has no object store", func() {
+			Expect(os.Setenv("VCAP_SERVICES", testdata.EnvWithUserProvidedIAS)).To(Succeed())
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("AMS_BUNDLE_SOURCE=object-store requires an identity binding with authorization_object_store credentials")))
+		})
+	})
+	When("the service bindings are delivered in VCAP_SERVICES_FILE_PATH", func() {
+		BeforeEach(func() {
+			vcapServices = ""
+			vcapFile := filepath.Join(buildDir, "vcap_services.json")
+			Expect(os.WriteFile(vcapFile, []byte(testdata.EnvWithIASAuthX509), 0600)).To(Succeed())
+			os.Setenv("VCAP_SERVICES_FILE_PATH", vcapFile)
+			os.Setenv("AMS_DCL_ROOT", "/policies")
+		})
+		AfterEach(func() {
+			os.Unsetenv("VCAP_SERVICES_FILE_PATH")
+		})
+		It("uploads the policies with the identity binding from the file", func() {
+			Expect(supplier.Run()).To(Succeed())
+			Expect(certSpy).To(Equal([]byte(testdata.IdentityCert)))
+			Expect(uploadReqSpy.URL.String()).To(Equal("https://mytenant.accounts400.ondemand.com/sap/ams/v1/ams-instances/00000000-3b4d-4c41-9e5b-9aee7bfa6348/dcl-upload"))
+		})
+	})
+	When("bundle polling is configured", func() {
+		BeforeEach(func() {
+			vcapServices = testdata.EnvWithIASAuthX509
+		})
+		AfterEach(func() {
+			os.Unsetenv("AMS_BUNDLE_POLL_MIN")
+			os.Unsetenv("AMS_BUNDLE_POLL_MAX")
+			os.Unsetenv("AMS_BUNDLE_LONG_POLLING_TIMEOUT")
+		})
+		readPolling := func() download.PollingConfig {
+			rawConfig, err := os.ReadFile(filepath.Join(depDir, "opa_config.yml"))
+			Expect(err).NotTo(HaveOccurred())
+			cfg, err := config.ParseConfig(rawConfig, "testId")
+			Expect(err).NotTo(HaveOccurred())
+			var bundleConfig map[string]*bundle.Source
+			Expect(json.Unmarshal(cfg.Bundles, &bundleConfig)).To(Succeed())
+			Expect(bundleConfig).To(HaveKey("00000000-3b4d-4c41-9e5b-9aee7bfa6348"))
+			var validated map[string]*download.Config // validation converts the delays to nanoseconds
+			Expect(json.Unmarshal(cfg.Bundles, &validated)).To(Succeed())
+			Expect(validated["00000000-3b4d-4c41-9e5b-9aee7bfa6348"].ValidateAndInjectDefaults()).To(Succeed())
+			return bundleConfig["00000000-3b4d-4c41-9e5b-9aee7bfa6348"].Polling
+		}
+		It("uses AMS_BUNDLE_POLL_MIN and AMS_BUNDLE_POLL_MAX", func() {
+			os.Setenv("AMS_BUNDLE_POLL_MIN", "2")
+			os.Setenv("AMS_BUNDLE_POLL_MAX", "1m")
+			Expect(supplier.Run()).To(Succeed())
+			polling := readPolling()
+			Expect(*polling.MinDelaySeconds).To(Equal(int64(2)))
+			Expect(*polling.MaxDelaySeconds).To(Equal(int64(60)))
+			Expect(polling.LongPollingTimeoutSeconds).To(BeNil())
+		})
+		It("raises the default maximum to AMS_BUNDLE_POLL_MIN", func() {
+			os.Setenv("AMS_BUNDLE_POLL_MIN", "5m")
+			Expect(supplier.Run()).To(Succeed())
+			polling := readPolling()
+			Expect(*polling.MinDelaySeconds).To(Equal(int64(300)))
+			Expect(*polling.MaxDelaySeconds).To(Equal(int64(300)))
+		})
+		It("enables long polling", func() {
+			os.Setenv("AMS_BUNDLE_LONG_POLLING_TIMEOUT", "30s")
+			Expect(supplier.Run()).To(Succeed())
+			polling := readPolling()
+			Expect(*polling.LongPollingTimeoutSeconds).To(Equal(int64(30)))
+			Expect(*polling.MinDelaySeconds).To(Equal(int64(10)))
+			Expect(*polling.MaxDelaySeconds).To(Equal(int64(20)))
+		})
+		It("fails if the minimum exceeds the maximum", func() {
+			os.Setenv("AMS_BUNDLE_POLL_MIN", "30")
+			os.Setenv("AMS_BUNDLE_POLL_MAX", "15")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("AMS_BUNDLE_POLL_MIN (30s) must not be greater than AMS_BUNDLE_POLL_MAX (15s)")))
+		})
+		It("fails for fractions of seconds", func() {
+			os.Setenv("AMS_BUNDLE_LONG_POLLING_TIMEOUT", "500ms")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("invalid value for AMS_BUNDLE_LONG_POLLING_TIMEOUT: '500ms' is not a whole number of seconds of at least 1s")))
+		})
+		It("fails for invalid durations", func() {
+			os.Setenv("AMS_BUNDLE_POLL_MAX", "often")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("invalid value for AMS_BUNDLE_POLL_MAX")))
+		})
+	})
+	When("AMS_BUNDLE_PERSIST is set", func() {
+		BeforeEach(func() {
+			vcapServices = testdata.EnvWithIASAuthX509
+			os.Setenv("AMS_BUNDLE_PERSIST", "true")
+		})
+		AfterEach(func() {
+			os.Unsetenv("AMS_BUNDLE_PERSIST")
+			os.Unsetenv("AMS_BUNDLE_SEED")
+		})
+		It("configures OPA to persist the bundle in the deps dir", func() {
+			Expect(supplier.Run()).To(Succeed())
+			rawConfig, err := os.ReadFile(filepath.Join(depDir, "opa_config.yml"))
+			Expect(err).NotTo(HaveOccurred())
+			cfg, err := config.ParseConfig(rawConfig, "testId")
+			Expect(err).NotTo(HaveOccurred())
+			persistenceDir, err := cfg.GetPersistenceDirectory()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(persistenceDir).To(Equal("/home/vcap/deps/42/opa_persistence"))
+
+			var bundleConfig map[string]*bundle.Source
+			Expect(json.Unmarshal(cfg.Bundles, &bundleConfig)).To(Succeed())
+			Expect(bundleConfig["00000000-3b4d-4c41-9e5b-9aee7bfa6348"].Persist).To(BeTrue())
+			Expect(filepath.Join(depDir, "opa_persistence")).NotTo(BeADirectory())
+		})
+		It("seeds the persisted bundle with AMS_BUNDLE_SEED relative to the app root", func() {
+			Expect(os.WriteFile(filepath.Join(buildDir, "seed.tar.gz"), []byte("seed bundle"), 0600)).To(Succeed())
+			os.Setenv("AMS_BUNDLE_SEED", "seed.tar.gz")
+			Expect(supplier.Run()).To(Succeed())
+			persisted := filepath.Join(depDir, "opa_persistence", "bundles", "00000000-3b4d-4c41-9e5b-9aee7bfa6348", "bundle.tar.gz")
+			Expect(readFile(persisted)).To(Equal([]byte("seed bundle")))
+			Expect(writtenLogs.String()).To(ContainSubstring("seeded the persisted bundle of AMS instance '00000000-3b4d-4c41-9e5b-9aee7bfa6348'"))
+		})
+		It("fails if AMS_BUNDLE_SEED does not exist", func() {
+			os.Setenv("AMS_BUNDLE_SEED", "missing.tar.gz")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("could not seed the persisted bundle: could not open AMS_BUNDLE_SEED")))
+		})
+		It("fails if AMS_BUNDLE_SEED is set without AMS_BUNDLE_PERSIST", func() {
+			os.Unsetenv("AMS_BUNDLE_PERSIST")
+			os.Setenv("AMS_BUNDLE_SEED", "seed.tar.gz")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("AMS_BUNDLE_SEED requires AMS_BUNDLE_PERSIST=true")))
+		})
+	})
+	When("AMS_BUNDLE_PREFETCH is set", func() {
+		var (
+			bundleReqSpy *http.Request
+			bundleStatus int
+			bundleBody   []byte
+		)
+		persisted := func() string {
+			return filepath.Join(depDir, "opa_persistence", "bundles", "00000000-3b4d-4c41-9e5b-9aee7bfa6348", "bundle.tar.gz")
+		}
+		BeforeEach(func() {
+			vcapServices = testdata.EnvWithIASAuthX509
+			os.Setenv("AMS_DCL_ROOT", "/policies")
+			os.Setenv("AMS_BUNDLE_PERSIST", "true")
+			os.Setenv("AMS_BUNDLE_PREFETCH", "true")
+			bundleReqSpy = nil
+			bundleStatus = http.StatusOK
+			bundleBody = bundleArchive(map[string]string{
+				".manifest":       `{"revision":"rev-1","roots":["ams"]}`,
+				"ams/data.json":   `{"policies":["dcl.test"]}`,
+				"ams/policy.rego": "package ams\n\nallow { true }\n",
+			})
+			mockAMSClient = NewMockAMSClient(mockCtrl)
+			mockAMSClient.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+				if req.Method == http.MethodGet {
+					bundleReqSpy = req
+					return &http.Response{StatusCode: bundleStatus, Status: fmt.Sprintf("%d %s", bundleStatus, http.StatusText(bundleStatus)), Body: io.NopCloser(bytes.NewReader(bundleBody))}, nil
+				}
+				uploadReqSpy = spyRequest(req)
+				return &http.Response{StatusCode: 200, Body: io.NopCloser(nil)}, nil
+			}).AnyTimes()
+		})
+		AfterEach(func() {
+			os.Unsetenv("AMS_BUNDLE_PERSIST")
+			os.Unsetenv("AMS_BUNDLE_PREFETCH")
+			os.Unsetenv("AMS_BUNDLE_SEED")
+			os.Unsetenv("AMS_BUNDLE_SOURCE")
+		})
+		It("ships the bundle from the bundle gateway as persisted bundle", func() {
+			Expect(supplier.Run()).To(Succeed())
+			Expect(bundleReqSpy).NotTo(BeNil())
+			Expect(bundleReqSpy.URL.String()).To(Equal("https://mytenant.accounts400.ondemand.com/sap/ams/v1/bundles/00000000-3b4d-4c41-9e5b-9aee7bfa6348.tar.gz"))
+			Expect(bundleReqSpy.Header.Get(env.HeaderInstanceID)).To(Equal("00000000-3b4d-4c41-9e5b-9aee7bfa6348"))
+			Expect(certSpy).To(Equal([]byte(testdata.IdentityCert)))
+			Expect(readFile(persisted())).To(Equal(bundleBody))
+			Expect(writtenLogs.String()).To(ContainSubstring("prefetched the bundle of AMS instance '00000000-3b4d-4c41-9e5b-9aee7bfa6348' with revision 'rev-1'"))
+		})
+		It("replaces the seed", func() {
+			Expect(os.WriteFile(filepath.Join(buildDir, "seed.tar.gz"), []byte("seed bundle"), 0600)).To(Succeed())
+			os.Setenv("AMS_BUNDLE_SEED", "seed.tar.gz")
+			Expect(supplier.Run()).To(Succeed())
+			Expect(readFile(persisted())).To(Equal(bundleBody))
+		})
+		It("keeps the seed if the bundle is invalid", func() {
+			Expect(os.WriteFile(filepath.Join(buildDir, "seed.tar.gz"), []byte("seed bundle"), 0600)).To(Succeed())
+			os.Setenv("AMS_BUNDLE_SEED", "seed.tar.gz")
+			bundleBody = bundleArchive(map[string]string{"ams/policy.rego": "package ams\n\nallow {\n"})
+			Expect(supplier.Run()).To(Succeed())
+			Expect(readFile(persisted())).To(Equal([]byte("seed bundle")))
+			Expect(writtenLogs.String()).To(ContainSubstring("could not prefetch the bundle of AMS instance '00000000-3b4d-4c41-9e5b-9aee7bfa6348', the AMS sidecar downloads it at startup: invalid bundle"))
+		})
+		It("continues staging if the bundle is too large", func() {
+			mockAMSClient = NewMockAMSClient(mockCtrl)
+			mockAMSClient.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+				if req.Method == http.MethodGet {
+					return &http.Response{StatusCode: http.StatusOK, ContentLength: -1, Body: io.NopCloser(io.LimitReader(zeroReader{}, 64<<20))}, nil
+				}
+				uploadReqSpy = spyRequest(req)
+				return &http.Response{StatusCode: 200, Body: io.NopCloser(nil)}, nil
+			}).AnyTimes()
+			Expect(supplier.Run()).To(Succeed())
+			Expect(persisted()).NotTo(BeAnExistingFile())
+			Expect(writtenLogs.String()).To(ContainSubstring("bundle exceeds the maximum size of 33554432 bytes"))
+		})
+		It("continues staging if the bundle gateway is not available", func() {
+			bundleStatus = http.StatusServiceUnavailable
+			Expect(supplier.Run()).To(Succeed())
+			Expect(persisted()).NotTo(BeAnExistingFile())
+			Expect(writtenLogs.String()).To(ContainSubstring("/00000000-3b4d-4c41-9e5b-9aee7bfa6348.tar.gz returned status 503"))
+		})
+		It("fails if the bundle would conflict with the decision log mask", func() {
+			os.Setenv("AMS_DECISION_LOGS", "console")
+			os.Setenv("AMS_DECISION_LOGS_MASK", "/input/password")
+			defer os.Unsetenv("AMS_DECISION_LOGS")
+			defer os.Unsetenv("AMS_DECISION_LOGS_MASK")
+			bundleBody = bundleArchive(map[string]string{"ams/policy.rego": "package ams\n\nallow { true }\n"})
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("the roots [] of the bundle of AMS instance '00000000-3b4d-4c41-9e5b-9aee7bfa6348' overlap the root 'system/log' of the decision log mask")))
+			Expect(persisted()).NotTo(BeAnExistingFile())
+		})
+		It("fails without AMS_BUNDLE_PERSIST", func() {
+			os.Unsetenv("AMS_BUNDLE_PERSIST")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("AMS_BUNDLE_PREFETCH requires AMS_BUNDLE_PERSIST=true")))
+		})
+		It("fails for the object store", func() {
+			os.Setenv("AMS_BUNDLE_SOURCE", "object-store")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("AMS_BUNDLE_PREFETCH is only supported for AMS_BUNDLE_SOURCE=gateway")))
+		})
+	})
+	When("AMS_OPA_CONFIG_OVERLAY is set", func() {
+		BeforeEach(func() {
+			vcapServices = testdata.EnvWithIASAuthX509
+		})
+		AfterEach(func() {
+			os.Unsetenv("AMS_OPA_CONFIG_OVERLAY")
+		})
+		readConfig := func() map[string]interface{} {
+			rawConfig, err := os.ReadFile(filepath.Join(depDir, "opa_config.yml"))
+			Expect(err).NotTo(HaveOccurred())
+			var cfg map[string]interface{}
+			Expect(json.Unmarshal(rawConfig, &cfg)).To(Succeed())
+			return cfg
+		}
+		It("deep-merges the inline JSON into the generated config", func() {
+			os.Setenv("AMS_OPA_CONFIG_OVERLAY", `{
+				"caching": {"inter_query_builtin_cache": {"max_size_bytes": 10000000}},
+				"bundles": {"00000000-3b4d-4c41-9e5b-9aee7bfa6348": {"polling": {"max_delay_seconds": 60}}},
+				"services": {"bundle_storage": {"response_header_timeout_seconds": 20}}
+			}`)
+			Expect(supplier.Run()).To(Succeed())
+			cfg := readConfig()
+			Expect(cfg).To(HaveKeyWithValue("caching", HaveKeyWithValue("inter_query_builtin_cache", HaveKeyWithValue("max_size_bytes", BeNumerically("==", 10000000)))))
+			polling := cfg["bundles"].(map[string]interface{})["00000000-3b4d-4c41-9e5b-9aee7bfa6348"].(map[string]interface{})["polling"]
+			Expect(polling).To(HaveKeyWithValue("min_delay_seconds", BeNumerically("==", 10)))
+			Expect(polling).To(HaveKeyWithValue("max_delay_seconds", BeNumerically("==", 60)))
+			svc := cfg["services"].(map[string]interface{})["bundle_storage"]
+			Expect(svc).To(HaveKeyWithValue("response_header_timeout_seconds", BeNumerically("==", 20)))
+			Expect(svc).To(HaveKeyWithValue("url", "https://mytenant.accounts400.ondemand.com/sap/ams/v1/bundles"))
+			Expect(svc).To(HaveKey("credentials"))
+			Expect(cfg).To(HaveKeyWithValue("plugins", HaveKeyWithValue("dcl", true)))
+		})
+		It("reads the overlay from a YAML file in the app", func() {
+			Expect(os.WriteFile(filepath.Join(buildDir, "opa-overlay.yml"), []byte("server:\n  encoding:\n    gzip:\n      min_length: 1024\n"), 0600)).To(Succeed())
+			os.Setenv("AMS_OPA_CONFIG_OVERLAY", "opa-overlay.yml")
+			Expect(supplier.Run()).To(Succeed())
+			Expect(readConfig()).To(HaveKeyWithValue("server", HaveKeyWithValue("encoding", HaveKeyWithValue("gzip", HaveKeyWithValue("min_length", BeNumerically("==", 1024))))))
+			Expect(writtenLogs.String()).To(ContainSubstring("using the OPA config overlay from '" + filepath.Join(buildDir, "opa-overlay.yml") + "'"))
+		})
+		It("fails for the bundle service credentials", func() {
+			os.Setenv("AMS_OPA_CONFIG_OVERLAY", `{"services": {"bundle_storage": {"credentials": {"bearer": {"token": "t"}}}}}`)
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("AMS_OPA_CONFIG_OVERLAY must not set 'services.bundle_storage.credentials', it is configured by the buildpack")))
+		})
+		It("fails if the overlay replaces the bundle service", func() {
+			os.Setenv("AMS_OPA_CONFIG_OVERLAY", `services: []`)
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("AMS_OPA_CONFIG_OVERLAY must not set 'services'")))
+		})
+		It("fails if OPA rejects the merged config", func() {
+			os.Setenv("AMS_OPA_CONFIG_OVERLAY", `{"bundles": {"00000000-3b4d-4c41-9e5b-9aee7bfa6348": {"polling": {"min_delay_seconds": 30}}}}`)
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("invalid OPA config")))
+			Expect(filepath.Join(depDir, "opa_config.yml")).NotTo(BeAnExistingFile())
+		})
+		It("fails if the overlay is neither a file nor an object", func() {
+			os.Setenv("AMS_OPA_CONFIG_OVERLAY", "missing.yml")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("AMS_OPA_CONFIG_OVERLAY is neither a file in the app nor a JSON or YAML object")))
+		})
+	})
+	When("AMS_DECISION_LOGS is set", func() {
+		BeforeEach(func() {
+			vcapServices = testdata.EnvWithIASAuthX509
+		})
+		AfterEach(func() {
+			for _, name := range []string{"AMS_DECISION_LOGS", "AMS_DECISION_LOGS_URL", "AMS_DECISION_LOGS_MASK", "AMS_DECISION_LOGS_BUFFER_SIZE", "AMS_DECISION_LOGS_UPLOAD_SIZE"} {
+				os.Unsetenv(name)
+			}
+		})
+		readConfig := func() (*config.Config, *logs.Config) {
+			rawConfig, err := os.ReadFile(filepath.Join(depDir, "opa_config.yml"))
+			Expect(err).NotTo(HaveOccurred())
+			cfg, err := config.ParseConfig(rawConfig, "testId")
+			Expect(err).NotTo(HaveOccurred())
+			var restConfig map[string]json.RawMessage
+			Expect(json.Unmarshal(cfg.Services, &restConfig)).To(Succeed())
+			var services []string
+			for name := range restConfig {
+				services = append(services, name)
+			}
+			logsConfig, err := logs.ParseConfig(cfg.DecisionLogs, services, []string{"dcl"})
+			Expect(err).NotTo(HaveOccurred())
+			return cfg, logsConfig
+		}
+		readCommand := func() string {
+			launchConfig, err := os.Open(filepath.Join(depDir, "launch.yml"))
+			Expect(err).NotTo(HaveOccurred())
+			defer launchConfig.Close()
+			var ld supply.LaunchData
+			Expect(yaml.NewDecoder(launchConfig).Decode(&ld)).To(Succeed())
+			return ld.Processes[0].Command
+		}
+		It("logs no decisions by default", func() {
+			Expect(supplier.Run()).To(Succeed())
+			cfg, logsConfig := readConfig()
+			Expect(cfg.DecisionLogs).To(BeNil())
+			Expect(logsConfig).To(BeNil())
+		})
+		It("logs the decisions to the console with masked input fields", func() {
+			os.Setenv("AMS_DECISION_LOGS", "console")
+			os.Setenv("AMS_DECISION_LOGS_MASK", "/input/user/email, /input/password")
+			Expect(supplier.Run()).To(Succeed())
+			_, logsConfig := readConfig()
+			Expect(logsConfig.ConsoleLogs).To(BeTrue())
+			Expect(logsConfig.Service).To(BeEmpty())
+			Expect(*logsConfig.MaskDecision).To(Equal("/system/log/mask"))
+			Expect(readCommand()).To(HaveSuffix(`--disable-telemetry -b "/home/vcap/deps/42/decision_log_mask"`))
+
+			By("keeping the mask bundle when OPA activates the AMS bundle", func() {
+				ctx := context.Background()
+				store := inmem.New()
+				activate := func(name string, b *opabundle.Bundle) (*ast.Compiler, error) {
+					txn := storage.NewTransactionOrDie(ctx, store, storage.WriteParams)
+					compiler := ast.NewCompiler()
+					err := opabundle.Activate(&opabundle.ActivateOpts{Ctx: ctx, Store: store, Txn: txn, Compiler: compiler,
+						Metrics: metrics.New(), Bundles: map[string]*opabundle.Bundle{name: b}})
+					if err != nil {
+						store.Abort(ctx, txn)
+						return nil, err
+					}
+					return compiler, store.Commit(ctx, txn)
+				}
+				mask, err := loader.NewFileLoader().AsBundle(filepath.Join(depDir, "decision_log_mask"))
+				Expect(err).NotTo(HaveOccurred())
+				_, err = activate("decision_log_mask", mask)
+				Expect(err).NotTo(HaveOccurred())
+
+				ams, err := opabundle.NewReader(bytes.NewReader(bundleArchive(map[string]string{
+					".manifest":       `{"revision":"rev-1","roots":["ams"]}`,
+					"ams/policy.rego": "package ams\n\nallow { true }\n",
+				}))).Read()
+				Expect(err).NotTo(HaveOccurred())
+				compiler, err := activate("00000000-3b4d-4c41-9e5b-9aee7bfa6348", &ams)
+				Expect(err).NotTo(HaveOccurred())
+
+				rs, err := rego.New(rego.Query("data.system.log.mask"), rego.Compiler(compiler), rego.Store(store)).Eval(ctx)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rs).To(HaveLen(1))
+				Expect(rs[0].Expressions[0].Value).To(ConsistOf("/input/user/email", "/input/password"))
+
+				By("rejecting AMS bundles without roots, which would erase the mask", func() {
+					ams, err := opabundle.NewReader(bytes.NewReader(bundleArchive(map[string]string{
+						"ams/policy.rego": "package ams\n\nallow { true }\n",
+					}))).Read()
+					Expect(err).NotTo(HaveOccurred())
+					_, err = activate("00000000-3b4d-4c41-9e5b-9aee7bfa6348", &ams)
+					Expect(err).To(MatchError(ContainSubstring("detected overlapping roots in bundle manifest with: [decision_log_mask]")))
+				})
+			})
+		})
+		It("uploads the decisions to the remote service with the credentials of the identity binding", func() {
+			os.Setenv("AMS_DECISION_LOGS", "remote")
+			os.Setenv("AMS_DECISION_LOGS_URL", "https://logs.example.com/v1")
+			os.Setenv("AMS_DECISION_LOGS_BUFFER_SIZE", "4M")
+			os.Setenv("AMS_DECISION_LOGS_UPLOAD_SIZE", "512K")
+			Expect(supplier.Run()).To(Succeed())
+			cfg, logsConfig := readConfig()
+			Expect(logsConfig.ConsoleLogs).To(BeFalse())
+			Expect(logsConfig.Service).To(Equal("decision_logs"))
+			Expect(*logsConfig.Reporting.BufferSizeLimitBytes).To(Equal(int64(4 << 20)))
+			Expect(*logsConfig.Reporting.UploadSizeLimitBytes).To(Equal(int64(512 << 10)))
+			Expect(filepath.Join(depDir, "decision_log_mask")).NotTo(BeAnExistingFile())
+
+			var restConfig map[string]rest.Config
+			Expect(json.Unmarshal(cfg.Services, &restConfig)).To(Succeed())
+			Expect(restConfig["decision_logs"].URL).To(Equal("https://logs.example.com/v1"))
+			Expect(restConfig["decision_logs"].Credentials.ClientTLS).To(Equal(restConfig["bundle_storage"].Credentials.ClientTLS))
+			Expect(restConfig["decision_logs"].Headers).To(HaveKeyWithValue(env.HeaderInstanceID, "00000000-3b4d-4c41-9e5b-9aee7bfa6348"))
+		})
+		It("reads the client secret of the remote service from the file written by cert-to-disk", func() {
+			Expect(os.Setenv("VCAP_SERVICES", testdata.EnvWithIASAuthWithClientSecret)).To(Succeed())
+			os.Setenv("AMS_DECISION_LOGS", "remote")
+			os.Setenv("AMS_DECISION_LOGS_URL", "https://logs.example.com/v1")
+			Expect(supplier.Run()).To(Succeed())
+			cfg, _ := readConfig()
+			var restConfig map[string]rest.Config
+			Expect(json.Unmarshal(cfg.Services, &restConfig)).To(Succeed())
+			Expect(restConfig["decision_logs"].Credentials.OAuth2.TokenURL).To(Equal(restConfig["bundle_storage"].Credentials.OAuth2.TokenURL))
+			Expect(readCommand()).To(HaveSuffix(`--set-file "services.bundle_storage.credentials.oauth2.client_secret=/home/vcap/deps/42/ias.secret"` +
+				` --set-file "services.decision_logs.credentials.oauth2.client_secret=/home/vcap/deps/42/ias.secret"`))
+		})
+		It("fails without the URL of the remote service", func() {
+			os.Setenv("AMS_DECISION_LOGS", "remote")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("AMS_DECISION_LOGS=remote requires the absolute URL of the decision log service in AMS_DECISION_LOGS_URL")))
+		})
+		It("fails for unknown modes", func() {
+			os.Setenv("AMS_DECISION_LOGS", "file")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("invalid value for AMS_DECISION_LOGS: 'file'")))
+		})
+		It("fails for masks that are no JSON pointers", func() {
+			os.Setenv("AMS_DECISION_LOGS", "console")
+			os.Setenv("AMS_DECISION_LOGS_MASK", "input.password")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("invalid value for AMS_DECISION_LOGS_MASK: 'input.password' is no JSON pointer")))
+		})
+		It("fails for masks of other fields than the result", func() {
+			os.Setenv("AMS_DECISION_LOGS", "console")
+			os.Setenv("AMS_DECISION_LOGS_MASK", "/result/user, /resultfoo")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("invalid value for AMS_DECISION_LOGS_MASK: '/resultfoo' is no JSON pointer")))
+		})
+		It("fails for masks without decision logs", func() {
+			os.Setenv("AMS_DECISION_LOGS_MASK", "/input/password")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("AMS_DECISION_LOGS_MASK is only supported for AMS_DECISION_LOGS=console or remote")))
+		})
+		It("fails for buffer sizes of the console", func() {
+			os.Setenv("AMS_DECISION_LOGS", "console")
+			os.Setenv("AMS_DECISION_LOGS_BUFFER_SIZE", "4M")
+			Expect(supplier.Run()).To(MatchError(ContainSubstring("AMS_DECISION_LOGS_BUFFER_SIZE is only supported for AMS_DECISION_LOGS=remote")))
+		})
+	})
+	When("VCAP_SERVICES is no valid JSON", func() {
+		BeforeEach(func() {
+			vcapServices = "{"
+		})
 		It("should abort with err", func() {
 			err := supplier.Run()
 			Expect(err).To(HaveOccurred())
@@ -397,8 +1227,23 @@ var _ = Describe("Supply", func() {
 			Expect(supplier.Run()).To(Succeed())
 			Expect(filepath.Join(depDir, "launch.yml")).To(BeARegularFile())
 			Expect(uploadReqSpy.Host).To(Equal("megaclite.host"))
-			Expect(string(keySpy)).To(Equal("cf-instance-key-payload"))
-			Expect(string(certSpy)).To(Equal("cf-instance-cert-payload"))
+			Expect(keySpy).To(Equal(readFile("testdata/cf_instance_key.pem")))
+			Expect(certSpy).To(Equal(readFile("testdata/cf_instance_cert.pem")))
+			Expect(writtenLogs.String()).To(ContainSubstring("using CF instance certificate with subject 'CN=cf_instance-test-client,OU=SAP Cloud Platform Clients,O=SAP SE,C=DE'"))
+			Expect(writtenLogs.String()).To(ContainSubstring("issuer 'CN=AMS Test CA,O=SAP SE,C=DE' and serial number 1005"))
+		})
+		It("does not warn about the expiry of the CF instance certificate", func() {
+			os.Setenv("AMS_CERT_EXPIRY_WARNING", "10000d")
+			defer os.Unsetenv("AMS_CERT_EXPIRY_WARNING")
+			Expect(supplier.Run()).To(Succeed())
+			Expect(writtenLogs.String()).NotTo(ContainSubstring("the CF instance certificate expires"))
+		})
+		It("does not export a value-help certificate", func() {
+			Expect(supplier.Run()).To(Succeed())
+			env, err := os.ReadFile(path.Join(buildDir, ".profile.d", "0000_opa_env.sh"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(env)).To(ContainSubstring("export OPA_URL="))
+			Expect(string(env)).NotTo(ContainSubstring("AMS_VALUE_HELP_CERT"))
 		})
 		It("should configure OPA to access megaclite", func() {
 			Expect(supplier.Run()).To(Succeed())
@@ -443,7 +1288,7 @@ var _ = Describe("Supply", func() {
 		It("fails with proper error message", func() {
 			err = supplier.Run()
 			Expect(err).To(HaveOccurred())
-			Expect(err.Error()).To(ContainSubstring("identity certificate has expired:"))
+			Expect(err.Error()).To(ContainSubstring("invalid identity certificate: certificate has expired on 2021-11-28T09:57:08Z"))
 		})
 	})
 })
@@ -478,3 +1323,40 @@ func getTgzFileNames(r io.Reader) []string {
 	}
 	return files
 }
+
+// spyRequest buffers the request body, which is backed by a temporary archive file that is removed after the upload.
+func spyRequest(req *http.Request) *http.Request {
+	body, err := io.ReadAll(req.Body)
+	Expect(err).NotTo(HaveOccurred())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return req
+}
+
+// bundleArchive returns a gzipped tarball with the files.
+func bundleArchive(files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		Expect(tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})).To(Succeed())
+		_, err := tw.Write([]byte(content))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+	Expect(gw.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+// zeroReader returns an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func readFile(name string) []byte {
+	b, err := os.ReadFile(name)
+	Expect(err).NotTo(HaveOccurred())
+	return b
+}
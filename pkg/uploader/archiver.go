@@ -2,15 +2,20 @@ package uploader
 
 import (
 	"archive/tar"
-	"bytes"
 	"compress/gzip"
-	"encoding/base64"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/cloudfoundry/libbuildpack"
 )
@@ -18,47 +23,220 @@ import (
 type archiveContent struct {
 	header *tar.Header
 	file   string
+	root   string
 }
 
-func CreateArchive(log *libbuildpack.Logger, root string) (*bytes.Buffer, error) {
-	var buf bytes.Buffer
-	zr := gzip.NewWriter(&buf)
-	tw := tar.NewWriter(zr)
+// Archive is a policy upload archive, stored in a temporary file so that it can be re-read for every upload attempt
+// without keeping it in memory. Close removes the file.
+type Archive struct {
+	file      *os.File
+	Size      int64
+	FileCount int
+	Digest    string
+	Files     []ArchivedFile
+}
+
+// ArchivedFile describes a file packed into an Archive.
+type ArchivedFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+// ArchiveOptions control which files CreateArchive packs and how large the archive may get.
+type ArchiveOptions struct {
+	Filter FileFilter
+	// MaxSize is the maximum size of the compressed archive in bytes, 0 means unlimited.
+	MaxSize int64
+}
 
-	rootInfo, err := os.Lstat(root)
+// ErrArchiveTooLarge is returned by CreateArchive if the archive exceeds ArchiveOptions.MaxSize.
+var ErrArchiveTooLarge = errors.New("policy archive too large")
+
+// archiveModTime is used for all archive entries, so that identical DCLs always result in identical archives.
+var archiveModTime = time.Unix(0, 0)
+
+// CreateArchive packs the files of all roots that pass the filter into one reproducible tar.gz archive: entries are
+// sorted by path and timestamps, modes and ownership are normalized. The roots are merged, so each path relative
+// to its root may only be provided by one of them.
+func CreateArchive(log *libbuildpack.Logger, roots []string, opts ArchiveOptions) (*Archive, error) {
+	content, err := selectContent(log, roots, opts.Filter)
 	if err != nil {
-		checkAlternativeRoots(log, root)
 		return nil, err
 	}
-
-	content, err := crawlDCLs(rootInfo, root, root)
+	f, err := os.CreateTemp("", "dcl-*.tar.gz")
 	if err != nil {
+		return nil, fmt.Errorf("could not create temporary policy archive: %w", err)
+	}
+	archive := &Archive{file: f}
+	if err := archive.write(log, content, opts.MaxSize); err != nil {
+		archive.Close()
 		return nil, err
 	}
-	for _, c := range *content {
+	log.Info("created policy archive with %d file(s) and %d bytes", archive.FileCount, archive.Size)
+	return archive, nil
+}
+
+func (a *Archive) write(log *libbuildpack.Logger, content []archiveContent, maxSize int64) error {
+	archiveHash := sha256.New()
+	counter := &limitWriter{w: io.MultiWriter(a.file, archiveHash), max: maxSize}
+	zr := gzip.NewWriter(counter)
+	tw := tar.NewWriter(zr)
+	for _, c := range content {
 		if err := tw.WriteHeader(c.header); err != nil {
-			return nil, err
+			return err
 		}
 		if c.file != "" {
 			log.Info("adding file '%s' to policy upload archive", c.header.Name)
-			data, err := os.Open(c.file)
-			if err != nil {
-				return nil, err
-			}
-			if _, err := io.Copy(tw, data); err != nil {
-				return nil, err
+			fileHash := sha256.New()
+			if err := copyFile(io.MultiWriter(tw, fileHash), c.file); err != nil {
+				return err
 			}
+			a.FileCount++
+			a.Files = append(a.Files, ArchivedFile{Name: c.header.Name, Size: c.header.Size, Digest: formatDigest(fileHash)})
 		}
 	}
 	if err := tw.Close(); err != nil {
-		return nil, err
+		return err
 	}
 	if err := zr.Close(); err != nil {
+		return err
+	}
+	a.Size = counter.n
+	a.Digest = formatDigest(archiveHash)
+	return nil
+}
+
+func formatDigest(h hash.Hash) string {
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Reader returns a new reader over the whole archive. Readers are independent of each other.
+func (a *Archive) Reader() io.Reader {
+	return io.NewSectionReader(a.file, 0, a.Size)
+}
+
+// Close removes the temporary archive file.
+func (a *Archive) Close() error {
+	err := a.file.Close()
+	if rmErr := os.Remove(a.file.Name()); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// limitWriter counts the bytes written and fails as soon as more than max bytes (if > 0) are written.
+type limitWriter struct {
+	w   io.Writer
+	n   int64
+	max int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if l.max > 0 && l.n+int64(len(p)) > l.max {
+		return 0, fmt.Errorf("%w: the compressed archive exceeds the maximum size of %d bytes; "+
+			"exclude files from the upload or raise AMS_DCL_MAX_ARCHIVE_SIZE", ErrArchiveTooLarge, l.max)
+	}
+	n, err := l.w.Write(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// SourceFile is a file selected for the policy upload archive.
+type SourceFile struct {
+	// Name is the slash separated path relative to its DCL root, as used in the archive
+	Name string
+	// Path is the location of the file on disk
+	Path string
+}
+
+// ListFiles returns the files that CreateArchive would pack, sorted by name.
+func ListFiles(roots []string, filter FileFilter) ([]SourceFile, error) {
+	content, _, err := crawlRoots(roots, filter)
+	if err != nil {
+		return nil, err
+	}
+	var files []SourceFile
+	for _, entry := range content {
+		if entry.file != "" {
+			files = append(files, SourceFile{Name: entry.header.Name, Path: entry.file})
+		}
+	}
+	return files, nil
+}
+
+func selectContent(log *libbuildpack.Logger, roots []string, filter FileFilter) ([]archiveContent, error) {
+	for _, root := range roots {
+		if _, err := os.Lstat(root); err != nil {
+			checkAlternativeRoots(log, root)
+			return nil, err
+		}
+	}
+	content, skipped, err := crawlRoots(roots, filter)
+	if err != nil {
 		return nil, err
 	}
+	// files that don't match the include patterns are summarized, they are usually not meant to be uploaded
+	var unmatched int
+	for _, sf := range skipped {
+		if sf.excluded {
+			log.Warning("skipping '%s' in policy upload archive: %s", sf.name, sf.reason)
+			continue
+		}
+		unmatched++
+		log.Debug("skipping '%s' in policy upload archive: %s", sf.name, sf.reason)
+	}
+	if unmatched > 0 {
+		log.Warning("skipping %d file(s) in policy upload archive that are not matched by the include patterns, set BP_DEBUG to list them", unmatched)
+	}
+	return content, nil
+}
+
+// crawlRoots merges the content of all roots. Directories present in several roots are merged, while files
+// (or a file and a directory) with the same relative path are reported as conflicts instead of overwriting each other.
+func crawlRoots(roots []string, filter FileFilter) ([]archiveContent, []skippedFile, error) {
+	var result []archiveContent
+	var skipped []skippedFile
+	var conflicts []string
+	seen := make(map[string]archiveContent)
+	for _, root := range roots {
+		c, err := newCrawler(root, filter)
+		if err != nil {
+			return nil, nil, err
+		}
+		content, err := c.crawl()
+		if err != nil {
+			return nil, nil, err
+		}
+		skipped = append(skipped, c.skipped...)
+		for _, entry := range content {
+			prev, ok := seen[entry.header.Name]
+			if !ok {
+				seen[entry.header.Name] = entry
+				result = append(result, entry)
+				continue
+			}
+			if prev.file == "" && entry.file == "" {
+				continue
+			}
+			conflicts = append(conflicts, fmt.Sprintf("'%s' exists in '%s' and '%s'", entry.header.Name, prev.root, entry.root))
+		}
+	}
+	if len(conflicts) > 0 {
+		return nil, nil, fmt.Errorf("conflicting paths in DCL roots: %s", strings.Join(conflicts, "; "))
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].header.Name < result[j].header.Name })
+	return result, skipped, nil
+}
 
-	log.Debug("built tar: %s", base64.StdEncoding.EncodeToString(buf.Bytes()))
-	return &buf, nil
+func copyFile(w io.Writer, file string) error {
+	data, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	_, err = io.Copy(w, data)
+	return err
 }
 
 func checkAlternativeRoots(log *libbuildpack.Logger, root string) {
@@ -77,22 +255,61 @@ func checkAlternativeRoots(log *libbuildpack.Logger, root string) {
 	}
 }
 
-func crawlDCLs(fi os.FileInfo, file, root string) (*[]archiveContent, error) {
+type crawler struct {
+	root    string
+	filter  FileFilter
+	skipped []skippedFile
+}
+
+func newCrawler(root string, filter FileFilter) (*crawler, error) {
+	f, err := filter.withIgnoreFile(root)
+	if err != nil {
+		return nil, err
+	}
+	return &crawler{root: root, filter: f}, nil
+}
+
+func (c *crawler) crawl() ([]archiveContent, error) {
+	rootInfo, err := os.Lstat(c.root)
+	if err != nil {
+		return nil, err
+	}
+	content, err := c.crawlDCLs(rootInfo, c.root)
+	if err != nil {
+		return nil, err
+	}
+	return *content, nil
+}
+
+func (c *crawler) crawlDCLs(fi os.FileInfo, file string) (*[]archiveContent, error) {
 	var archive []archiveContent
+	if file != c.root {
+		relPath, err := filepath.Rel(c.root, file)
+		if err != nil {
+			return nil, err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if reason, excluded := c.filter.skipReason(relPath, fi.IsDir()); reason != "" {
+			if reason != "hidden" {
+				c.skipped = append(c.skipped, skippedFile{name: relPath, reason: reason, excluded: excluded})
+			}
+			return &archive, nil
+		}
+	}
 	if fi.IsDir() {
 		content, err := ioutil.ReadDir(file)
 		if err != nil {
 			return nil, err
 		}
 		for _, cfi := range content {
-			carchive, err := crawlDCLs(cfi, path.Join(file, cfi.Name()), root)
+			carchive, err := c.crawlDCLs(cfi, path.Join(file, cfi.Name()))
 			if err != nil {
 				return nil, err
 			}
 			archive = append(archive, *carchive...)
 		}
-		if len(archive) > 0 && file != root {
-			ce, err := createContentEntry(fi, file, root)
+		if len(archive) > 0 && file != c.root {
+			ce, err := createContentEntry(fi, file, c.root)
 			if err != nil {
 				return nil, err
 			}
@@ -100,26 +317,36 @@ func crawlDCLs(fi os.FileInfo, file, root string) (*[]archiveContent, error) {
 		}
 		return &archive, nil
 	}
-	return createContentEntry(fi, file, root)
+	return createContentEntry(fi, file, c.root)
 }
 
 func createContentEntry(fi os.FileInfo, file, root string) (*[]archiveContent, error) {
 	var result archiveContent
-	if !fi.IsDir() && !strings.HasSuffix(file, ".dcl") {
-		return &[]archiveContent{}, nil
-	}
-
 	relPath, err := filepath.Rel(root, file)
 	if err != nil {
 		return nil, err
 	}
-	result.header, err = tar.FileInfoHeader(fi, relPath)
-	if err != nil {
-		return nil, err
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if fi, err = os.Stat(file); err != nil {
+			return nil, err
+		}
+		if fi.IsDir() { // symlinked directories are not followed
+			return &[]archiveContent{}, nil
+		}
 	}
 
-	result.header.Name = filepath.ToSlash(relPath)
-	if !fi.IsDir() {
+	result.root = root
+	result.header = &tar.Header{
+		Name:    filepath.ToSlash(relPath),
+		ModTime: archiveModTime,
+	}
+	if fi.IsDir() {
+		result.header.Typeflag = tar.TypeDir
+		result.header.Mode = 0755
+	} else {
+		result.header.Typeflag = tar.TypeReg
+		result.header.Mode = 0644
+		result.header.Size = fi.Size()
 		result.file = file
 	}
 	return &[]archiveContent{result}, nil
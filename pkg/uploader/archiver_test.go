@@ -4,6 +4,8 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +13,7 @@ import (
 	"path"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cloudfoundry/libbuildpack"
 	"github.com/stretchr/testify/assert"
@@ -24,6 +27,7 @@ func TestCreateArchive(t *testing.T) {
 	tests := []struct {
 		name    string
 		rootDir string
+		filter  FileFilter
 		input   map[string]string
 		wantErr assert.ErrorAssertionFunc
 		want    map[string]string // value can be _DIR_ to indicate a directory
@@ -54,6 +58,38 @@ func TestCreateArchive(t *testing.T) {
 			"policies":          "_DIR_",
 			"policies/dcl1.dcl": "POLICIES 123 {}",
 		}},
+		{name: "include patterns", rootDir: "/", filter: FileFilter{Include: []string{"*.dcl", "policies/*.json"}}, input: map[string]string{
+			"schema.dcl":         "SCHEMA {}",
+			"data.json":          "{}",
+			"policies/dcl1.dcl":  "POLICIES 123 {}",
+			"policies/data.json": "{}",
+		}, wantErr: assert.NoError, want: map[string]string{
+			"schema.dcl":         "SCHEMA {}",
+			"policies":           "_DIR_",
+			"policies/dcl1.dcl":  "POLICIES 123 {}",
+			"policies/data.json": "{}",
+		}},
+		{name: "exclude patterns", rootDir: "/", filter: FileFilter{Exclude: []string{"tests/", "**/draft_*.dcl"}}, input: map[string]string{
+			"schema.dcl":               "SCHEMA {}",
+			"tests/test.dcl":           "POLICIES 123 {}",
+			"policies/dcl1.dcl":        "POLICIES 123 {}",
+			"policies/a/draft_dcl.dcl": "POLICIES 123 {}",
+		}, wantErr: assert.NoError, want: map[string]string{
+			"schema.dcl":        "SCHEMA {}",
+			"policies":          "_DIR_",
+			"policies/dcl1.dcl": "POLICIES 123 {}",
+		}},
+		{name: "amsignore file and hidden dirs", rootDir: "/", input: map[string]string{
+			".amsignore":        "# comment\n\nlegacy\n",
+			".git/a.dcl":        "POLICIES 123 {}",
+			"schema.dcl":        "SCHEMA {}",
+			"legacy/dcl1.dcl":   "POLICIES 123 {}",
+			"policies/dcl1.dcl": "POLICIES 123 {}",
+		}, wantErr: assert.NoError, want: map[string]string{
+			"schema.dcl":        "SCHEMA {}",
+			"policies":          "_DIR_",
+			"policies/dcl1.dcl": "POLICIES 123 {}",
+		}},
 	}
 
 	for _, tt := range tests {
@@ -70,16 +106,192 @@ func TestCreateArchive(t *testing.T) {
 				createFile(t, path.Join(tempDir, name), content)
 			}
 
-			buf, err := CreateArchive(logger, path.Join(tempDir, tt.rootDir))
+			archive, err := CreateArchive(logger, []string{path.Join(tempDir, tt.rootDir)}, ArchiveOptions{Filter: tt.filter})
 			tt.wantErr(t, err)
 
 			if err == nil {
-				assertBundleContent(t, buf, tt.want)
+				defer archive.Close()
+				assert.Equal(t, countFiles(tt.want), archive.FileCount)
+				assertBundleContent(t, archive.Reader(), tt.want)
 			}
 		})
 	}
 }
 
+func TestCreateArchiveLogsSkippedFiles(t *testing.T) {
+	writtenLogs := new(bytes.Buffer)
+	logger := libbuildpack.NewLogger(writtenLogs)
+	tempDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(tempDir, ".git"), 0700))
+	createFile(t, path.Join(tempDir, ".git", "config"), "")
+	createFile(t, path.Join(tempDir, "schema.dcl"), "SCHEMA {}")
+	createFile(t, path.Join(tempDir, "data.json"), "{}")
+	createFile(t, path.Join(tempDir, "old.dcl"), "SCHEMA {}")
+	createFile(t, path.Join(tempDir, "draft.dcl"), "SCHEMA {}")
+	createFile(t, path.Join(tempDir, IgnoreFile), "draft.dcl")
+
+	_, err := CreateArchive(logger, []string{tempDir}, ArchiveOptions{Filter: FileFilter{Exclude: []string{"old.*"}}})
+	require.NoError(t, err)
+
+	assert.Contains(t, writtenLogs.String(), "adding file 'schema.dcl'")
+	assert.Contains(t, writtenLogs.String(), "skipping 'old.dcl' in policy upload archive: excluded by pattern 'old.*'")
+	assert.Contains(t, writtenLogs.String(), "skipping 'draft.dcl' in policy upload archive: excluded by pattern 'draft.dcl'")
+	assert.Contains(t, writtenLogs.String(), "skipping 1 file(s) in policy upload archive that are not matched by the include patterns")
+	assert.NotContains(t, writtenLogs.String(), "data.json")
+	assert.NotContains(t, writtenLogs.String(), ".git")
+}
+
+func TestCreateArchiveLogsUnmatchedFilesInDebugMode(t *testing.T) {
+	t.Setenv("BP_DEBUG", "true")
+	writtenLogs := new(bytes.Buffer)
+	logger := libbuildpack.NewLogger(writtenLogs)
+	tempDir := t.TempDir()
+	createFile(t, path.Join(tempDir, "schema.dcl"), "SCHEMA {}")
+	createFile(t, path.Join(tempDir, "data.json"), "{}")
+
+	_, err := CreateArchive(logger, []string{tempDir}, ArchiveOptions{})
+	require.NoError(t, err)
+
+	assert.Contains(t, writtenLogs.String(), "skipping 'data.json' in policy upload archive: not matched by include patterns [*.dcl]")
+	assert.Equal(t, 1, strings.Count(writtenLogs.String(), "WARNING"))
+}
+
+func TestCreateArchiveIsReproducible(t *testing.T) {
+	logger := libbuildpack.NewLogger(new(bytes.Buffer))
+	createRoot := func(modTime time.Time, perm os.FileMode) string {
+		tempDir := t.TempDir()
+		require.NoError(t, os.MkdirAll(path.Join(tempDir, "policies"), 0700))
+		for name, content := range map[string]string{"schema.dcl": "SCHEMA {}", "policies/dcl1.dcl": "POLICIES 123 {}"} {
+			require.NoError(t, os.WriteFile(path.Join(tempDir, name), []byte(content), perm))
+			require.NoError(t, os.Chtimes(path.Join(tempDir, name), modTime, modTime))
+		}
+		return tempDir
+	}
+
+	first, err := CreateArchive(logger, []string{createRoot(time.Now().Add(-time.Hour), 0600)}, ArchiveOptions{})
+	require.NoError(t, err)
+	second, err := CreateArchive(logger, []string{createRoot(time.Now(), 0640)}, ArchiveOptions{})
+	require.NoError(t, err)
+
+	defer first.Close()
+	defer second.Close()
+
+	firstBytes, err := io.ReadAll(first.Reader())
+	require.NoError(t, err)
+	secondBytes, err := io.ReadAll(second.Reader())
+	require.NoError(t, err)
+	assert.Equal(t, firstBytes, secondBytes)
+	assert.Equal(t, first.Digest, second.Digest)
+	sum := sha256.Sum256(firstBytes)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), first.Digest)
+	assert.Equal(t, int64(len(firstBytes)), first.Size)
+
+	gzReader, err := gzip.NewReader(first.Reader())
+	require.NoError(t, err)
+	tarReader := tar.NewReader(gzReader)
+	var names []string
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, header.Name)
+		assert.Equal(t, int64(0), header.ModTime.Unix())
+		assert.Equal(t, 0, header.Uid)
+		assert.Equal(t, 0, header.Gid)
+		assert.Empty(t, header.Uname)
+		assert.Empty(t, header.Gname)
+	}
+	assert.Equal(t, []string{"policies", "policies/dcl1.dcl", "schema.dcl"}, names)
+}
+
+func TestListFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(tempDir, "policies"), 0700))
+	createFile(t, path.Join(tempDir, "schema.dcl"), "SCHEMA {}")
+	createFile(t, path.Join(tempDir, "policies", "dcl1.dcl"), "POLICIES 123 {}")
+	createFile(t, path.Join(tempDir, "policies", "data.json"), "{}")
+
+	files, err := ListFiles([]string{tempDir}, FileFilter{Include: []string{"*.dcl", "*.json"}})
+	require.NoError(t, err)
+	assert.Equal(t, []SourceFile{
+		{Name: "policies/data.json", Path: path.Join(tempDir, "policies", "data.json")},
+		{Name: "policies/dcl1.dcl", Path: path.Join(tempDir, "policies", "dcl1.dcl")},
+		{Name: "schema.dcl", Path: path.Join(tempDir, "schema.dcl")},
+	}, files)
+}
+
+func TestCreateArchiveMultipleRoots(t *testing.T) {
+	logger := libbuildpack.NewLogger(new(bytes.Buffer))
+	createRoot := func(files map[string]string) string {
+		root := t.TempDir()
+		for name, content := range files {
+			require.NoError(t, os.MkdirAll(path.Dir(path.Join(root, name)), 0700))
+			createFile(t, path.Join(root, name), content)
+		}
+		return root
+	}
+
+	t.Run("merges roots", func(t *testing.T) {
+		schemaRoot := createRoot(map[string]string{"schema.dcl": "SCHEMA {}"})
+		salesRoot := createRoot(map[string]string{"sales/sales.dcl": "POLICY sales {}", "shared/a.dcl": "POLICY a {}"})
+		hrRoot := createRoot(map[string]string{"hr/hr.dcl": "POLICY hr {}", "shared/b.dcl": "POLICY b {}"})
+
+		archive, err := CreateArchive(logger, []string{schemaRoot, salesRoot, hrRoot}, ArchiveOptions{})
+		require.NoError(t, err)
+		defer archive.Close()
+		assertBundleContent(t, archive.Reader(), map[string]string{
+			"schema.dcl":      "SCHEMA {}",
+			"sales":           "_DIR_",
+			"sales/sales.dcl": "POLICY sales {}",
+			"hr":              "_DIR_",
+			"hr/hr.dcl":       "POLICY hr {}",
+			"shared":          "_DIR_",
+			"shared/a.dcl":    "POLICY a {}",
+			"shared/b.dcl":    "POLICY b {}",
+		})
+	})
+	t.Run("reports conflicting paths", func(t *testing.T) {
+		first := createRoot(map[string]string{"schema.dcl": "SCHEMA {}", "sales/sales.dcl": "POLICY sales {}"})
+		second := createRoot(map[string]string{"schema.dcl": "SCHEMA {}", "sales/sales.dcl": "POLICY sales {}", "hr/hr.dcl": "POLICY hr {}"})
+
+		_, err := CreateArchive(logger, []string{first, second}, ArchiveOptions{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), fmt.Sprintf("'schema.dcl' exists in '%s' and '%s'", first, second))
+		assert.Contains(t, err.Error(), fmt.Sprintf("'sales/sales.dcl' exists in '%s' and '%s'", first, second))
+		assert.NotContains(t, err.Error(), "hr.dcl")
+	})
+}
+
+func TestCreateArchiveMaxSize(t *testing.T) {
+	writtenLogs := new(bytes.Buffer)
+	logger := libbuildpack.NewLogger(writtenLogs)
+	tempDir := t.TempDir()
+	createFile(t, path.Join(tempDir, "schema.dcl"), "SCHEMA {}")
+
+	archive, err := CreateArchive(logger, []string{tempDir}, ArchiveOptions{MaxSize: 1 << 10})
+	require.NoError(t, err)
+	defer archive.Close()
+	assert.Contains(t, writtenLogs.String(), fmt.Sprintf("created policy archive with 1 file(s) and %d bytes", archive.Size))
+	assert.NotContains(t, writtenLogs.String(), "built tar")
+
+	_, err = CreateArchive(logger, []string{tempDir}, ArchiveOptions{MaxSize: 10})
+	assert.ErrorIs(t, err, ErrArchiveTooLarge)
+	assert.ErrorContains(t, err, "exceeds the maximum size of 10 bytes")
+}
+
+func TestArchiveClose(t *testing.T) {
+	tempDir := t.TempDir()
+	createFile(t, path.Join(tempDir, "schema.dcl"), "SCHEMA {}")
+	archive, err := CreateArchive(libbuildpack.NewLogger(io.Discard), []string{tempDir}, ArchiveOptions{})
+	require.NoError(t, err)
+	require.FileExists(t, archive.file.Name())
+
+	require.NoError(t, archive.Close())
+	assert.NoFileExists(t, archive.file.Name())
+}
+
 func TestCreateArchiveJavaLog(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -105,7 +317,7 @@ func TestCreateArchiveJavaLog(t *testing.T) {
 			err = os.MkdirAll(dirs, 0700)
 			require.NoError(t, err)
 
-			_, err = CreateArchive(logger, path.Join(tempDir, tt.rootDir))
+			_, err = CreateArchive(logger, []string{path.Join(tempDir, tt.rootDir)}, ArchiveOptions{})
 			tt.wantErr(t, err)
 
 			assert.Contains(t, writtenLogs.String(), tt.wantLog)
@@ -118,8 +330,8 @@ func createFile(t *testing.T, name, content string) {
 	require.NoError(t, err)
 }
 
-func assertBundleContent(t *testing.T, buffer *bytes.Buffer, expected map[string]string) {
-	gzReader, err := gzip.NewReader(buffer)
+func assertBundleContent(t *testing.T, r io.Reader, expected map[string]string) {
+	gzReader, err := gzip.NewReader(r)
 	require.NoError(t, err)
 
 	defer gzReader.Close()
@@ -157,3 +369,13 @@ func assertBundleContent(t *testing.T, buffer *bytes.Buffer, expected map[string
 
 	assert.Equalf(t, len(expected), len(actualFiles)+len(actualDirs), "unexpected amount of files/dirs in archive. files: %s, dirs: %s", actualFiles, actualDirs)
 }
+
+func countFiles(expected map[string]string) int {
+	var n int
+	for _, content := range expected {
+		if content != "_DIR_" {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,55 @@
+package uploader
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The digest of the last successfully uploaded archive is kept per AMS instance in the staging cache directory.
+const cacheSubDir = "ams-dcl-upload"
+
+func (up *Uploader) digestCacheFile() string {
+	return filepath.Join(up.CacheDir, cacheSubDir, up.AMSInstanceID+".digest")
+}
+
+func (up *Uploader) cachedDigest() (string, error) {
+	b, err := os.ReadFile(up.digestCacheFile())
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(b)), err
+}
+
+func (up *Uploader) storeDigest(digest string) error {
+	if err := os.MkdirAll(filepath.Dir(up.digestCacheFile()), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(up.digestCacheFile(), []byte(digest), 0644) //nolint:gosec
+}
+
+// shouldUpload decides whether the archive needs to be uploaded and logs the reason.
+func (up *Uploader) shouldUpload(archive *Archive) bool {
+	if up.CacheDir == "" {
+		return true
+	}
+	if up.ForceUpload {
+		up.Log.Info("uploading policies: AMS_FORCE_UPLOAD is set")
+		return true
+	}
+	previous, err := up.cachedDigest()
+	switch {
+	case err != nil:
+		up.Log.Warning("uploading policies: could not read the digest of the last upload: %s", err)
+	case previous == "":
+		up.Log.Info("uploading policies: no previous upload to AMS instance '%s' recorded in the staging cache", up.AMSInstanceID)
+	case previous != archive.Digest:
+		up.Log.Info("uploading policies: archive changed since the last upload to AMS instance '%s' (previous digest %s)", up.AMSInstanceID, previous)
+	default:
+		up.Log.Info("skipping policy upload: archive is unchanged since the last successful upload to AMS instance '%s' (set AMS_FORCE_UPLOAD=true to upload anyway)", up.AMSInstanceID)
+		return false
+	}
+	return true
+}
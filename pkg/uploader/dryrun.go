@@ -0,0 +1,92 @@
+package uploader
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+)
+
+const (
+	DryRunArchiveFile  = "dcl-upload-dry-run.tar.gz"
+	DryRunManifestFile = "dcl-upload-dry-run.json"
+)
+
+// DryRunManifest describes the upload request that would have been sent to the AMS server.
+type DryRunManifest struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Archive DryRunArchive     `json:"archive"`
+	Files   []ArchivedFile    `json:"files"`
+}
+
+type DryRunArchive struct {
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+const redacted = "<redacted>"
+
+// DryRun creates the policy archive like Do, but instead of uploading it, the archive and a DryRunManifest are
+// written to dir. Header values that may contain secrets, like the bearer token of Auth, are redacted in the manifest.
+func (up *Uploader) DryRun(dstURL, dir string) error {
+	up.Log.Info("creating policy archive (dry run)..")
+	archive, err := CreateArchive(up.Log, up.Roots, ArchiveOptions{Filter: up.Filter, MaxSize: up.MaxArchiveSize})
+	if err != nil {
+		return fmt.Errorf("could not create policy DCL.tar.gz: %w", err)
+	}
+	defer archive.Close()
+	up.Log.Info("policy archive digest: %s", archive.Digest)
+	uploadURL, err := up.uploadURL(dstURL)
+	if err != nil {
+		return err
+	}
+
+	archivePath := filepath.Join(dir, DryRunArchiveFile)
+	if err := writeArchive(archive, archivePath); err != nil {
+		return fmt.Errorf("could not write policy archive: %w", err)
+	}
+	manifest := DryRunManifest{
+		URL:     uploadURL,
+		Headers: make(map[string]string),
+		Archive: DryRunArchive{File: DryRunArchiveFile, Size: archive.Size, Digest: archive.Digest},
+		Files:   archive.Files,
+	}
+	for key, values := range up.headers(archive) {
+		manifest.Headers[key] = redactHeader(key, strings.Join(values, ", "))
+	}
+	if up.Auth != nil { // the token is not requested, since the dry run contacts no server
+		manifest.Headers["Authorization"] = "Bearer " + redacted
+	}
+	manifestPath := filepath.Join(dir, DryRunManifestFile)
+	if err := libbuildpack.NewJSON().Write(manifestPath, manifest); err != nil {
+		return fmt.Errorf("could not write dry run manifest: %w", err)
+	}
+	up.Log.Info("dry run: skipping policy upload to %s, wrote '%s' and '%s'", uploadURL, archivePath, manifestPath)
+	return nil
+}
+
+func writeArchive(archive *Archive, dst string) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, archive.Reader()); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func redactHeader(key, value string) string {
+	k := strings.ToLower(key)
+	if k == "authorization" || k == "proxy-authorization" || k == "cookie" ||
+		strings.Contains(k, "token") || strings.Contains(k, "secret") || strings.Contains(k, "password") {
+		return redacted
+	}
+	return value
+}
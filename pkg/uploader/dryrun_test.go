@@ -0,0 +1,67 @@
+package uploader
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRun(t *testing.T) {
+	root := t.TempDir()
+	out := t.TempDir()
+	createFile(t, path.Join(root, "schema.dcl"), "SCHEMA {}")
+	up := Uploader{
+		Log:           libbuildpack.NewLogger(io.Discard),
+		Roots:         []string{root},
+		AMSInstanceID: "instance-id",
+		ExtraHeaders: map[string]string{
+			"Authorization": "Bearer my-token",
+			"X-Api-Token":   "my-token",
+			"X-Appname":     "my-app",
+		},
+	}
+
+	require.NoError(t, up.DryRun("https://ams.example.com/base", out))
+
+	var manifest DryRunManifest
+	require.NoError(t, libbuildpack.NewJSON().Load(path.Join(out, DryRunManifestFile), &manifest))
+	assert.Equal(t, "https://ams.example.com/base/sap/ams/v1/ams-instances/instance-id/dcl-upload", manifest.URL)
+	assert.Equal(t, redacted, manifest.Headers["Authorization"])
+	assert.Equal(t, redacted, manifest.Headers["X-Api-Token"])
+	assert.Equal(t, "my-app", manifest.Headers["X-Appname"])
+	assert.Equal(t, []ArchivedFile{{
+		Name:   "schema.dcl",
+		Size:   9,
+		Digest: "sha256:34d2c2e814a1f13f5daad7094ff20f1f4a196144fb13eb848c2a019f266b68a8",
+	}}, manifest.Files)
+
+	fi, err := os.Stat(path.Join(out, DryRunArchiveFile))
+	require.NoError(t, err)
+	assert.Equal(t, manifest.Archive.Size, fi.Size())
+}
+
+func TestDryRunWithClientCredentials(t *testing.T) {
+	root := t.TempDir()
+	out := t.TempDir()
+	createFile(t, path.Join(root, "schema.dcl"), "SCHEMA {}")
+	up := Uploader{
+		Log:           libbuildpack.NewLogger(io.Discard),
+		Roots:         []string{root},
+		AMSInstanceID: "instance-id",
+		Auth:          &ClientCredentials{TokenURL: "https://tenant.example.com/oauth2/token", ClientID: "client-id", ClientSecret: "client-secret"},
+	}
+
+	require.NoError(t, up.DryRun("https://ams.example.com/base", out))
+
+	var manifest DryRunManifest
+	require.NoError(t, libbuildpack.NewJSON().Load(path.Join(out, DryRunManifestFile), &manifest))
+	assert.Equal(t, "Bearer "+redacted, manifest.Headers["Authorization"])
+	raw, err := os.ReadFile(path.Join(out, DryRunManifestFile))
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), "client-secret")
+}
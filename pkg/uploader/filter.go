@@ -0,0 +1,120 @@
+package uploader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFile may be placed in the DCL root to exclude files from the policy upload, one glob pattern per line.
+const IgnoreFile = ".amsignore"
+
+// DefaultInclude is used when no include patterns are configured.
+var DefaultInclude = []string{"*.dcl"}
+
+// FileFilter selects the files of the DCL root that are added to the policy upload archive.
+//
+// Patterns without a slash match the file or directory name at any depth (e.g. "*.json"), patterns with a slash
+// match the path relative to the DCL root, where "**" matches any number of directories (e.g. "tests/**/*.dcl").
+// A trailing slash restricts a pattern to directories. Exclude patterns win over include patterns, and
+// excluding a directory skips its whole content. Hidden files and directories (like .git) are always skipped.
+type FileFilter struct {
+	Include []string
+	Exclude []string
+}
+
+type skippedFile struct {
+	name   string
+	reason string
+	// excluded is set if an exclude pattern of AMS_DCL_EXCLUDE or the IgnoreFile removed the file.
+	excluded bool
+}
+
+// withIgnoreFile returns a copy of the filter extended by the exclude patterns of the IgnoreFile in root, if any.
+func (f FileFilter) withIgnoreFile(root string) (FileFilter, error) {
+	result := FileFilter{Include: f.Include, Exclude: append([]string{}, f.Exclude...)}
+	if len(result.Include) == 0 {
+		result.Include = DefaultInclude
+	}
+	file, err := os.Open(filepath.Join(root, IgnoreFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return result, nil
+	} else if err != nil {
+		return FileFilter{}, fmt.Errorf("could not read %s: %w", IgnoreFile, err)
+	}
+	defer file.Close()
+	sc := bufio.NewScanner(file)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		result.Exclude = append(result.Exclude, line)
+	}
+	if err := sc.Err(); err != nil {
+		return FileFilter{}, fmt.Errorf("could not read %s: %w", IgnoreFile, err)
+	}
+	return result, nil
+}
+
+// skipReason returns why the file or directory with the given root-relative slash path is not part of the archive,
+// or an empty string if it is. excluded reports whether an exclude pattern matched.
+func (f FileFilter) skipReason(relPath string, isDir bool) (reason string, excluded bool) {
+	if strings.HasPrefix(path.Base(relPath), ".") {
+		return "hidden", false
+	}
+	for _, p := range f.Exclude {
+		if matchPattern(p, relPath, isDir) {
+			return fmt.Sprintf("excluded by pattern '%s'", p), true
+		}
+	}
+	if isDir {
+		return "", false
+	}
+	for _, p := range f.Include {
+		if matchPattern(p, relPath, isDir) {
+			return "", false
+		}
+	}
+	return fmt.Sprintf("not matched by include patterns %s", f.Include), false
+}
+
+func matchPattern(pattern, relPath string, isDir bool) bool {
+	if strings.HasSuffix(pattern, "/") {
+		if !isDir {
+			return false
+		}
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(relPath))
+		return ok
+	}
+	return matchSegments(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), strings.Split(relPath, "/"))
+}
+
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], segments[1:])
+}
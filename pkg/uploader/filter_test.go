@@ -0,0 +1,35 @@
+package uploader
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_matchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		relPath string
+		isDir   bool
+		want    bool
+	}{
+		{pattern: "*.dcl", relPath: "schema.dcl", want: true},
+		{pattern: "*.dcl", relPath: "a/b/policy.dcl", want: true},
+		{pattern: "*.dcl", relPath: "a/b/data.json", want: false},
+		{pattern: "tests", relPath: "a/tests", isDir: true, want: true},
+		{pattern: "tests/", relPath: "tests", isDir: true, want: true},
+		{pattern: "tests/", relPath: "tests", isDir: false, want: false},
+		{pattern: "a/*.json", relPath: "a/data.json", want: true},
+		{pattern: "a/*.json", relPath: "b/a/data.json", want: false},
+		{pattern: "/a/*.json", relPath: "a/data.json", want: true},
+		{pattern: "**/data.json", relPath: "data.json", want: true},
+		{pattern: "**/data.json", relPath: "a/b/data.json", want: true},
+		{pattern: "a/**/*.dcl", relPath: "a/b/c/policy.dcl", want: true},
+		{pattern: "a/**/*.dcl", relPath: "b/c/policy.dcl", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.relPath, func(t *testing.T) {
+			assert.Equal(t, tt.want, matchPattern(tt.pattern, tt.relPath, tt.isDir))
+		})
+	}
+}
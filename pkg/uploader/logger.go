@@ -7,7 +7,12 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path"
+	"strconv"
+	"strings"
 	"unicode"
+
+	"github.com/cloudfoundry/libbuildpack"
 )
 
 type Dclssue struct {
@@ -42,64 +47,195 @@ func (up *Uploader) logResponse(res *http.Response, reqURL string) error {
 	if res.StatusCode == http.StatusBadRequest {
 		var ce CompileError
 		if err = json.Unmarshal(b, &ce); err == nil {
-			if err = up.printCompileError(ce); err == nil {
-				return fmt.Errorf("DCL upload failed: status(%s) body(%s)", res.Status, string(b))
-			}
+			up.printCompileError(ce)
+			return fmt.Errorf("DCL upload failed: status(%s) body(%s)", res.Status, string(b))
 		}
 	}
 	return fmt.Errorf("unexpected response on DCL upload to %s: status(%s) body(%s)", reqURL, res.Status, string(b))
 }
-func (up *Uploader) printCompileError(compileError CompileError) error {
-	for file, issues := range compileError.CompileError.DclIssues {
+func (up *Uploader) printCompileError(compileError CompileError) {
+	if up.Report != nil {
+		if err := up.Report.Write(up.Roots, compileError.CompileError.DclIssues); err != nil {
+			up.Log.Warning("could not write DCL issue report: %s", err)
+		}
+	}
+	IssuePrinter{Log: up.Log, Roots: up.Roots, ContextLines: up.ContextLines}.Print(compileError.CompileError.DclIssues)
+}
+
+const DefaultContextLines = 2
+
+// IssuePrinter logs DCL issues grouped by file, each with a code frame of the offending line and a marker at the
+// reported column.
+type IssuePrinter struct {
+	Log *libbuildpack.Logger
+	// Roots are the directories the files of the issues are resolved against.
+	Roots []string
+	// ContextLines is the number of source lines shown before and after the offending line.
+	ContextLines int
+}
+
+// Print logs all issues followed by a summary. Files or lines that cannot be read are noted instead of their code
+// frame.
+func (p IssuePrinter) Print(dclIssues map[string][]Dclssue) {
+	if len(dclIssues) == 0 {
+		return
+	}
+	var errors, warnings int
+	for _, file := range sortedFiles(dclIssues) {
+		issues := sortedIssues(dclIssues[file])
+		fileErrors, fileWarnings := countSeverities(issues)
+		errors += fileErrors
+		warnings += fileWarnings
+		p.Log.Info("%s: %d error(s), %d warning(s)", file, fileErrors, fileWarnings)
+
+		lines, readErr := readLines(resolveFile(p.Roots, file))
 		for _, issue := range issues {
-			reader, err := os.Open(up.Root + file)
-			if err != nil {
-				return err
-			}
-			line, err := readLine(reader, issue.Line)
-			if err != nil {
-				return err
-			}
-			logFunc := up.Log.Info
+			logFunc := p.Log.Info
 			if issue.Severity == severityError {
-				logFunc = up.Log.Error
+				logFunc = p.Log.Error
 			} else if issue.Severity == severityWarning {
-				logFunc = up.Log.Warning
+				logFunc = p.Log.Warning
+			}
+			logFunc("%s", createHeaderLine(issue, file))
+			switch {
+			case readErr != nil:
+				p.Log.Info("  (source not available: %s)", readErr)
+			case issue.Line < 1 || issue.Line > len(lines):
+				p.Log.Info("  (line %d not found in %s)", issue.Line, file)
+			default:
+				for _, line := range p.codeFrame(lines, issue) {
+					p.Log.Info("%s", line)
+				}
 			}
+		}
+	}
+	p.Log.Info("found %d error(s) and %d warning(s) in %d file(s)", errors, warnings, len(dclIssues))
+}
+
+// codeFrame returns the offending line of the issue surrounded by the context lines, and a marker line below it.
+func (p IssuePrinter) codeFrame(lines []string, issue Dclssue) []string {
+	first := max(issue.Line-p.ContextLines, 1)
+	last := min(issue.Line+p.ContextLines, len(lines))
+	width := len(strconv.Itoa(last))
+	var frame []string
+	for n := first; n <= last; n++ {
+		prefix := "  "
+		if n == issue.Line {
+			prefix = "> "
+		}
+		frame = append(frame, strings.TrimRight(fmt.Sprintf("%s%*d | %s", prefix, width, n, expandTabs(lines[n-1])), " "))
+		if n == issue.Line && issue.Column > 0 {
+			frame = append(frame, fmt.Sprintf("  %*s | %s", width, "", createMarkerLine(lines[n-1], issue.Column)))
+		}
+	}
+	return frame
+}
 
-			logFunc(createHeaderLine(issue, file))
-			logFunc(line)
-			logFunc(createMarkerLine(line, issue.Column))
+func countSeverities(issues []Dclssue) (errors, warnings int) {
+	for _, issue := range issues {
+		switch issue.Severity {
+		case severityError:
+			errors++
+		case severityWarning:
+			warnings++
 		}
 	}
-	return nil
+	return errors, warnings
 }
+
 func createHeaderLine(issue Dclssue, file string) string {
 	if issue.SyntaxError {
 		return fmt.Sprintf("Syntax Error in %v line %v: %v ", file, issue.Line, issue.Message)
 	}
 	return fmt.Sprintf("%v in %v line %v: %v ", issue.Severity, file, issue.Line, issue.Message)
 }
-func createMarkerLine(line string, col int) (markerLine string) {
-	for i, rune := range line {
-		if i == col-1 {
-			markerLine += "^"
-		} else if unicode.IsSpace(rune) {
-			markerLine += string(rune)
+
+const tabWidth = 4
+
+// createMarkerLine returns a line with a caret below the 1-based column col of line, which counts characters, not
+// bytes. Tabs and wide characters are taken into account like in expandTabs.
+func createMarkerLine(line string, col int) string {
+	var width int
+	runes := []rune(line)
+	for i := 0; i < col-1 && i < len(runes); i++ {
+		width += displayWidth(runes[i], width)
+	}
+	if col-1 > len(runes) {
+		width += col - 1 - len(runes)
+	}
+	return strings.Repeat(" ", width) + "^"
+}
+
+// expandTabs replaces tabs with spaces up to the next tab stop.
+func expandTabs(line string) string {
+	if !strings.ContainsRune(line, '\t') {
+		return line
+	}
+	var sb strings.Builder
+	var width int
+	for _, r := range line {
+		w := displayWidth(r, width)
+		if r == '\t' {
+			sb.WriteString(strings.Repeat(" ", w))
 		} else {
-			markerLine += " "
+			sb.WriteRune(r)
 		}
+		width += w
 	}
-	return markerLine
+	return sb.String()
 }
-func readLine(r io.Reader, lineNum int) (line string, err error) {
-	sc := bufio.NewScanner(r)
-	var lastLine int
+
+// displayWidth returns the number of terminal cells of r at the given position of a line.
+func displayWidth(r rune, pos int) int {
+	switch {
+	case r == '\t':
+		return tabWidth - pos%tabWidth
+	case unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r) || r == '\u200B' || r == '\uFEFF':
+		return 0
+	case isWide(r):
+		return 2
+	default:
+		return 1
+	}
+}
+
+// isWide reports whether r is an East Asian wide or fullwidth character.
+func isWide(r rune) bool {
+	return r >= 0x1100 && (r <= 0x115F || // Hangul Jamo
+		(r >= 0x2E80 && r <= 0xA4CF && r != 0x303F) || // CJK, Hiragana, Katakana, Yi
+		(r >= 0xAC00 && r <= 0xD7A3) || // Hangul syllables
+		(r >= 0xF900 && r <= 0xFAFF) || // CJK compatibility ideographs
+		(r >= 0xFE30 && r <= 0xFE4F) || // CJK compatibility forms
+		(r >= 0xFF00 && r <= 0xFF60) || // fullwidth forms
+		(r >= 0xFFE0 && r <= 0xFFE6) ||
+		(r >= 0x1F300 && r <= 0x1F64F) || // emoji
+		(r >= 0x1F900 && r <= 0x1F9FF) ||
+		(r >= 0x20000 && r <= 0x3FFFD))
+}
+
+func readLines(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	sc := bufio.NewScanner(f)
 	for sc.Scan() {
-		lastLine++
-		if lastLine == lineNum {
-			return sc.Text(), sc.Err()
+		lines = append(lines, strings.TrimSuffix(sc.Text(), "\r"))
+	}
+	return lines, sc.Err()
+}
+
+// resolveFile returns the location of the root-relative file in the first root that contains it.
+func resolveFile(roots []string, file string) string {
+	for _, root := range roots {
+		if _, err := os.Stat(path.Join(root, file)); err == nil {
+			return path.Join(root, file)
 		}
 	}
-	return line, io.EOF
+	if len(roots) == 0 {
+		return file
+	}
+	return path.Join(roots[0], file)
 }
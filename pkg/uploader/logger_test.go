@@ -0,0 +1,76 @@
+package uploader
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_createMarkerLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		col  int
+		want string
+	}{
+		{name: "first column", line: "GRANT read;", col: 1, want: "^"},
+		{name: "ascii", line: "GRANT read;", col: 7, want: "      ^"},
+		{name: "tab", line: "\tGRANT read;", col: 2, want: "    ^"},
+		{name: "tab after text", line: "ab\tc", col: 4, want: "    ^"},
+		{name: "multi-byte", line: "POLICY ärger {", col: 9, want: "        ^"},
+		{name: "wide characters", line: "名前 = 1", col: 4, want: "     ^"},
+		{name: "combining character", line: "é = 1", col: 4, want: "  ^"},
+		{name: "after end of line", line: "GRANT", col: 7, want: "      ^"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, createMarkerLine(tt.line, tt.col))
+		})
+	}
+}
+
+func TestIssuePrinter(t *testing.T) {
+	root := t.TempDir()
+	createFile(t, path.Join(root, "schema.dcl"), "SCHEMA {\n\tname: String,\n\tcity: Strin,\n\tzip: Number\n}\n")
+	createFile(t, path.Join(root, "sales.dcl"), "POLICY sales {\r\n\tGRANT read ON x WHERE 名前 = 1 AND foo;\r\n}\r\n")
+	logs := new(bytes.Buffer)
+	printer := IssuePrinter{Log: libbuildpack.NewLogger(logs), Roots: []string{root}, ContextLines: 1}
+
+	printer.Print(map[string][]Dclssue{
+		"schema.dcl": {{Line: 3, Column: 8, Message: "unknown type 'Strin'", Severity: severityWarning}},
+		"sales.dcl": {
+			{Line: 9, Column: 1, Message: "unexpected end of file", Severity: severityError},
+			{Line: 2, Column: 35, Message: "expected comparison", Severity: severityError, SyntaxError: true},
+		},
+		"missing.dcl": {{Line: 1, Column: 1, Message: "not found", Severity: severityError}},
+	})
+
+	got := strings.Split(strings.TrimSuffix(logs.String(), "\n"), "\n")
+	for i := range got {
+		got[i] = strings.TrimPrefix(got[i], "       ")
+	}
+	assert.Equal(t, []string{
+		"missing.dcl: 1 error(s), 0 warning(s)",
+		"\x1b[31;1m**ERROR**\x1b[0m ERROR in missing.dcl line 1: not found ",
+		"  (source not available: open " + path.Join(root, "missing.dcl") + ": no such file or directory)",
+		"sales.dcl: 2 error(s), 0 warning(s)",
+		"\x1b[31;1m**ERROR**\x1b[0m Syntax Error in sales.dcl line 2: expected comparison ",
+		"  1 | POLICY sales {",
+		"> 2 |     GRANT read ON x WHERE 名前 = 1 AND foo;",
+		"    |                                        ^",
+		"  3 | }",
+		"\x1b[31;1m**ERROR**\x1b[0m ERROR in sales.dcl line 9: unexpected end of file ",
+		"  (line 9 not found in sales.dcl)",
+		"schema.dcl: 0 error(s), 1 warning(s)",
+		"\x1b[31;1m**WARNING**\x1b[0m WARNING in schema.dcl line 3: unknown type 'Strin' ",
+		"  2 |     name: String,",
+		"> 3 |     city: Strin,",
+		"    |           ^",
+		"  4 |     zip: Number",
+		"found 3 error(s) and 1 warning(s) in 3 file(s)",
+	}, got)
+}
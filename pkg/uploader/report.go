@@ -0,0 +1,250 @@
+package uploader
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	SARIFReportFile = "dcl-issues.sarif"
+	JUnitReportFile = "dcl-issues.junit.xml"
+)
+
+// IssueReport writes DCL issues as SARIF and JUnit XML files, so that CI pipelines and code review tools can annotate
+// the affected DCL lines.
+type IssueReport struct {
+	// Dirs are the directories the report files are written to.
+	Dirs []string
+	// BaseDir is the directory the file locations in the reports are relative to, usually the app root. If it is
+	// empty, the locations are relative to the DCL roots.
+	BaseDir string
+}
+
+// Write writes the issues of the DCL files below roots to every directory of the report.
+func (r IssueReport) Write(roots []string, dclIssues map[string][]Dclssue) error {
+	files := r.reportFiles(roots, dclIssues)
+	for _, dir := range r.Dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := writeReportFile(filepath.Join(dir, SARIFReportFile), files, WriteSARIF); err != nil {
+			return fmt.Errorf("could not write SARIF report: %w", err)
+		}
+		if err := writeReportFile(filepath.Join(dir, JUnitReportFile), files, WriteJUnit); err != nil {
+			return fmt.Errorf("could not write JUnit report: %w", err)
+		}
+	}
+	return nil
+}
+
+// reportFiles maps the issues to the file locations used in the reports.
+func (r IssueReport) reportFiles(roots []string, dclIssues map[string][]Dclssue) map[string][]Dclssue {
+	if r.BaseDir == "" {
+		return dclIssues
+	}
+	result := make(map[string][]Dclssue, len(dclIssues))
+	for file, issues := range dclIssues {
+		name := file
+		if rel, err := filepath.Rel(r.BaseDir, resolveFile(roots, file)); err == nil {
+			name = filepath.ToSlash(rel)
+		}
+		result[name] = append(result[name], issues...)
+	}
+	return result
+}
+
+func writeReportFile(name string, dclIssues map[string][]Dclssue, write func(io.Writer, map[string][]Dclssue) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := write(f, dclIssues); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver struct {
+		Name           string `json:"name"`
+		InformationURI string `json:"informationUri"`
+	} `json:"driver"`
+}
+
+type sarifResult struct {
+	RuleID  string `json:"ruleId"`
+	Level   string `json:"level"`
+	Message struct {
+		Text string `json:"text"`
+	} `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region *sarifRegion `json:"region,omitempty"`
+	} `json:"physicalLocation"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+// WriteSARIF writes the issues as SARIF 2.1.0 log.
+func WriteSARIF(w io.Writer, dclIssues map[string][]Dclssue) error {
+	run := sarifRun{Results: []sarifResult{}}
+	run.Tool.Driver.Name = "ams-dcl"
+	run.Tool.Driver.InformationURI = "https://github.com/SAP/cloud-authorization-buildpack"
+	for _, file := range sortedFiles(dclIssues) {
+		for _, issue := range sortedIssues(dclIssues[file]) {
+			result := sarifResult{RuleID: ruleID(issue), Level: sarifLevel(issue.Severity)}
+			result.Message.Text = issue.Message
+			var loc sarifLocation
+			loc.PhysicalLocation.ArtifactLocation.URI = file
+			if issue.Line > 0 {
+				loc.PhysicalLocation.Region = &sarifRegion{StartLine: issue.Line, StartColumn: issue.Column}
+			}
+			result.Locations = []sarifLocation{loc}
+			run.Results = append(run.Results, result)
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
+
+func ruleID(issue Dclssue) string {
+	switch {
+	case issue.Code != 0:
+		return "DCL" + strconv.Itoa(issue.Code)
+	case issue.SyntaxError:
+		return "DCL-SYNTAX"
+	default:
+		return "DCL"
+	}
+}
+
+func sarifLevel(severity string) string {
+	switch severity {
+	case severityError:
+		return "error"
+	case severityWarning:
+		return "warning"
+	default:
+		return "note"
+	}
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the issues as JUnit XML with one test case per DCL file, which fails if the file has errors.
+func WriteJUnit(w io.Writer, dclIssues map[string][]Dclssue) error {
+	suite := junitTestSuite{Name: "DCL compilation"}
+	for _, file := range sortedFiles(dclIssues) {
+		tc := junitTestCase{Name: file, ClassName: "dcl", File: file}
+		var text strings.Builder
+		var firstError string
+		var errorCount int
+		for _, issue := range sortedIssues(dclIssues[file]) {
+			fmt.Fprintf(&text, "%s:%d:%d: %s: %s\n", file, issue.Line, issue.Column, issue.Severity, issue.Message)
+			if issue.Severity == severityError {
+				if errorCount == 0 {
+					firstError = issue.Message
+				}
+				errorCount++
+			}
+		}
+		if errorCount > 0 {
+			tc.Failure = &junitFailure{Message: fmt.Sprintf("%d error(s), first: %s", errorCount, firstError), Type: severityError, Text: text.String()}
+			suite.Failures++
+		} else {
+			tc.SystemOut = text.String()
+		}
+		suite.Cases = append(suite.Cases, tc)
+		suite.Tests++
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Name: "dcl", Tests: suite.Tests, Failures: suite.Failures, Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func sortedFiles(dclIssues map[string][]Dclssue) []string {
+	files := make([]string, 0, len(dclIssues))
+	for file := range dclIssues {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func sortedIssues(issues []Dclssue) []Dclssue {
+	result := append([]Dclssue(nil), issues...)
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Line != result[j].Line {
+			return result[i].Line < result[j].Line
+		}
+		return result[i].Column < result[j].Column
+	})
+	return result
+}
@@ -0,0 +1,91 @@
+package uploader
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var reportIssues = map[string][]Dclssue{
+	"schema.dcl": {
+		{Line: 3, Column: 5, Message: "unknown type 'Text'", Severity: severityWarning, Code: 17},
+	},
+	"policies/sales.dcl": {
+		{Line: 7, Column: 12, Message: "expected ';'", Severity: severityError, SyntaxError: true},
+		{Line: 2, Column: 1, Message: "attribute 'foo' is not defined", Severity: severityError, Code: 42},
+	},
+}
+
+func TestWriteSARIF(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteSARIF(&buf, reportIssues))
+
+	var log sarifLog
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &log))
+	assert.Equal(t, "2.1.0", log.Version)
+	require.Len(t, log.Runs, 1)
+	results := log.Runs[0].Results
+	require.Len(t, results, 3)
+
+	assert.Equal(t, "DCL42", results[0].RuleID)
+	assert.Equal(t, "error", results[0].Level)
+	assert.Equal(t, "policies/sales.dcl", results[0].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+	assert.Equal(t, &sarifRegion{StartLine: 2, StartColumn: 1}, results[0].Locations[0].PhysicalLocation.Region)
+
+	assert.Equal(t, "DCL-SYNTAX", results[1].RuleID)
+	assert.Equal(t, "expected ';'", results[1].Message.Text)
+	assert.Equal(t, &sarifRegion{StartLine: 7, StartColumn: 12}, results[1].Locations[0].PhysicalLocation.Region)
+
+	assert.Equal(t, "DCL17", results[2].RuleID)
+	assert.Equal(t, "warning", results[2].Level)
+	assert.Equal(t, "schema.dcl", results[2].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+}
+
+func TestWriteJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteJUnit(&buf, reportIssues))
+
+	var suites junitTestSuites
+	require.NoError(t, xml.Unmarshal(buf.Bytes(), &suites))
+	assert.Equal(t, 2, suites.Tests)
+	assert.Equal(t, 1, suites.Failures)
+	require.Len(t, suites.Suites, 1)
+	cases := suites.Suites[0].Cases
+	require.Len(t, cases, 2)
+
+	assert.Equal(t, "policies/sales.dcl", cases[0].Name)
+	require.NotNil(t, cases[0].Failure)
+	assert.Equal(t, "2 error(s), first: attribute 'foo' is not defined", cases[0].Failure.Message)
+	assert.Equal(t, "policies/sales.dcl:2:1: ERROR: attribute 'foo' is not defined\npolicies/sales.dcl:7:12: ERROR: expected ';'\n", cases[0].Failure.Text)
+
+	assert.Equal(t, "schema.dcl", cases[1].Name)
+	assert.Nil(t, cases[1].Failure)
+	assert.Equal(t, "schema.dcl:3:5: WARNING: unknown type 'Text'\n", cases[1].SystemOut)
+}
+
+func TestIssueReportWrite(t *testing.T) {
+	appDir := t.TempDir()
+	root := path.Join(appDir, "auth", "dcl")
+	require.NoError(t, os.MkdirAll(path.Join(root, "policies"), 0755))
+	createFile(t, path.Join(root, "schema.dcl"), "SCHEMA {}")
+	createFile(t, path.Join(root, "policies", "sales.dcl"), "POLICY sales {}")
+	outDirs := []string{path.Join(t.TempDir(), "reports"), t.TempDir()}
+
+	report := IssueReport{Dirs: outDirs, BaseDir: appDir}
+	require.NoError(t, report.Write([]string{root}, reportIssues))
+
+	for _, dir := range outDirs {
+		b, err := os.ReadFile(path.Join(dir, SARIFReportFile))
+		require.NoError(t, err)
+		assert.Contains(t, string(b), `"uri": "auth/dcl/policies/sales.dcl"`)
+		b, err = os.ReadFile(path.Join(dir, JUnitReportFile))
+		require.NoError(t, err)
+		assert.Contains(t, string(b), `file="auth/dcl/schema.dcl"`)
+	}
+}
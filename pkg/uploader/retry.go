@@ -0,0 +1,168 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls how failed DCL uploads are retried. Uploads are retried on transient network errors and on
+// responses that indicate a temporary problem, e.g. 401 while the certificate of a new binding is not yet accepted.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of requests, including the first one.
+	MaxAttempts int
+	// InitialBackoff is the wait time before the first retry, it is multiplied by Multiplier for every further retry.
+	InitialBackoff time.Duration
+	// MaxBackoff limits the exponential wait time, 0 means no limit.
+	MaxBackoff time.Duration
+	Multiplier float64
+	// Jitter randomizes each wait time by up to the given fraction, e.g. 0.2 for ±20%.
+	Jitter float64
+	// Timeout limits the duration of the upload including all retries, 0 means no limit.
+	Timeout time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    15,
+	InitialBackoff: 2 * time.Second,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+	Timeout:        5 * time.Minute,
+}
+
+// backoff returns the wait time before the given retry, starting with 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || d < float64(p.MaxBackoff)); i++ {
+		d *= p.Multiplier
+	}
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+func (up *Uploader) retryPolicy() RetryPolicy {
+	if up.Retry.MaxAttempts == 0 {
+		return DefaultRetryPolicy
+	}
+	return up.Retry
+}
+
+// DoWithRetries sends the archive to dstURL and retries according to the RetryPolicy of the Uploader. If all attempts
+// fail with a retryable status, the last response is returned.
+func (up *Uploader) DoWithRetries(ctx context.Context, dstURL string, archive *Archive) (*http.Response, error) {
+	policy := up.retryPolicy()
+	for attempt := 1; ; attempt++ {
+		resp, err := up.do(ctx, dstURL, archive)
+		if err != nil && (!isTransient(err) || ctx.Err() != nil) {
+			return nil, fmt.Errorf("DCL upload request unsuccessful: %w", err)
+		}
+		if err == nil && !isRetryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		wait := policy.backoff(attempt)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				wait = retryAfter
+			}
+		}
+		if attempt >= policy.MaxAttempts || exceedsDeadline(ctx, wait) {
+			if err != nil {
+				return nil, fmt.Errorf("DCL upload request unsuccessful after %d attempt(s): %w", attempt, err)
+			}
+			up.Log.Warning("giving up DCL upload after %d attempt(s)", attempt)
+			return resp, nil
+		}
+		switch {
+		case err != nil:
+			up.Log.Info("DCL upload request failed: %s, retrying after %s...", err, wait)
+		case resp.StatusCode == http.StatusUnauthorized && up.Auth != nil:
+			up.Auth.Invalidate()
+			up.Log.Info("access token is not accepted, retrying with a new token after %s...", wait)
+		case resp.StatusCode == http.StatusUnauthorized:
+			up.Log.Info("certificate is not accepted (yet), retrying after %s...", wait)
+		default:
+			up.Log.Info("DCL upload returned status %s, retrying after %s...", resp.Status, wait)
+		}
+		if resp != nil {
+			if err := drainResponseBody(resp.Body); err != nil {
+				return nil, fmt.Errorf("cannot drain response body: %w", err)
+			}
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, fmt.Errorf("DCL upload aborted after %d attempt(s): %w", attempt, err)
+		}
+	}
+}
+
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isTransient reports whether err is a network error that may not occur again on the next attempt.
+func isTransient(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+func exceedsDeadline(ctx context.Context, wait time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return ok && time.Now().Add(wait).After(deadline)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
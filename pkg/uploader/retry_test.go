@@ -0,0 +1,179 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type result struct {
+	status     int
+	retryAfter string
+	err        error
+}
+
+func TestDoWithRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		results    []result
+		policy     RetryPolicy
+		wantStatus int
+		wantErr    string
+		wantLog    string
+	}{
+		{name: "success", results: []result{{status: 200}}, wantStatus: 200},
+		{name: "bad request is not retried", results: []result{{status: 400}}, wantStatus: 400},
+		{name: "unauthorized until certificate is accepted", results: []result{{status: 401}, {status: 401}, {status: 200}},
+			wantStatus: 200, wantLog: "certificate is not accepted (yet), retrying after"},
+		{name: "transient status codes", results: []result{{status: 429}, {status: 502}, {status: 503}, {status: 504}, {status: 500}, {status: 201}},
+			wantStatus: 201, wantLog: "DCL upload returned status 503 Service Unavailable, retrying after"},
+		{name: "connection reset", results: []result{{err: syscall.ECONNRESET}, {status: 200}},
+			wantStatus: 200, wantLog: "DCL upload request failed"},
+		{name: "unexpected EOF", results: []result{{err: io.ErrUnexpectedEOF}, {status: 200}}, wantStatus: 200},
+		{name: "permanent network error", results: []result{{err: errors.New("x509: certificate signed by unknown authority")}},
+			wantErr: "certificate signed by unknown authority"},
+		{name: "max attempts with status", results: []result{{status: 503}, {status: 503}, {status: 503}},
+			wantStatus: 503, wantLog: "giving up DCL upload after 3 attempt(s)"},
+		{name: "max attempts with error", results: []result{{err: syscall.ECONNREFUSED}, {err: syscall.ECONNREFUSED}, {err: syscall.ECONNREFUSED}},
+			wantErr: "DCL upload request unsuccessful after 3 attempt(s)"},
+		{name: "retry after seconds", results: []result{{status: 429, retryAfter: "0"}, {status: 200}},
+			wantStatus: 200, wantLog: "retrying after 0s"},
+		{name: "retry after beyond deadline", results: []result{{status: 503, retryAfter: "3600"}},
+			policy:     RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Timeout: time.Minute},
+			wantStatus: 503, wantLog: "giving up DCL upload after 1 attempt(s)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			client := NewMockAMSClient(ctrl)
+			var calls []*gomock.Call
+			for _, r := range tt.results {
+				calls = append(calls, client.EXPECT().Do(gomock.Any()).DoAndReturn(func(req *http.Request) (*http.Response, error) {
+					assertBundleContent(t, req.Body, map[string]string{"schema.dcl": "SCHEMA {}"})
+					if r.err != nil {
+						return nil, r.err
+					}
+					resp := &http.Response{
+						StatusCode: r.status,
+						Status:     fmt.Sprintf("%d %s", r.status, http.StatusText(r.status)),
+						Header:     make(http.Header),
+						Body:       io.NopCloser(strings.NewReader("")),
+					}
+					if r.retryAfter != "" {
+						resp.Header.Set("Retry-After", r.retryAfter)
+					}
+					return resp, nil
+				}))
+			}
+			gomock.InOrder(calls...)
+
+			policy := tt.policy
+			if policy.MaxAttempts == 0 {
+				policy = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, Multiplier: 2, Jitter: 0.5}
+				if len(tt.results) > 3 {
+					policy.MaxAttempts = len(tt.results)
+				}
+			}
+			logs := new(bytes.Buffer)
+			up, archive := newRetryTestUploader(t, logs, client, policy)
+			ctx := context.Background()
+			if policy.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, policy.Timeout)
+				defer cancel()
+			}
+
+			resp, err := up.DoWithRetries(ctx, "https://ams.example.com/dcl-upload", archive)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			}
+			assert.Contains(t, logs.String(), tt.wantLog)
+		})
+	}
+}
+
+func TestDoWithRetriesStopsWaitingOnCancel(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	client := NewMockAMSClient(ctrl)
+	client.EXPECT().Do(gomock.Any()).Return(&http.Response{StatusCode: 401, Body: io.NopCloser(strings.NewReader(""))}, nil)
+	up, archive := newRetryTestUploader(t, new(bytes.Buffer), client, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := up.DoWithRetries(ctx, "https://ams.example.com/dcl-upload", archive)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Minute)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second, Multiplier: 2}
+	var got []time.Duration
+	for retry := 1; retry <= 6; retry++ {
+		got = append(got, p.backoff(retry))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}, got)
+
+	unlimited := RetryPolicy{InitialBackoff: time.Second, Multiplier: 2}
+	got = nil
+	for retry := 1; retry <= 6; retry++ {
+		got = append(got, unlimited.backoff(retry))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second}, got)
+
+	p.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		d := p.backoff(2)
+		assert.GreaterOrEqual(t, d, 1600*time.Millisecond)
+		assert.LessOrEqual(t, d, 2400*time.Millisecond)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{value: "", wantOK: false},
+		{value: "30", want: 30 * time.Second, wantOK: true},
+		{value: "-1", wantOK: false},
+		{value: "Thu, 01 Aug 2024 12:01:00 GMT", want: time.Minute, wantOK: true},
+		{value: "Thu, 01 Aug 2024 11:00:00 GMT", want: 0, wantOK: true},
+		{value: "soon", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.value, now)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func newRetryTestUploader(t *testing.T, logs io.Writer, client AMSClient, policy RetryPolicy) (*Uploader, *Archive) {
+	root := t.TempDir()
+	createFile(t, path.Join(root, "schema.dcl"), "SCHEMA {}")
+	log := libbuildpack.NewLogger(logs)
+	archive, err := CreateArchive(log, []string{root}, ArchiveOptions{})
+	require.NoError(t, err)
+	t.Cleanup(func() { archive.Close() })
+	return &Uploader{Log: log, Client: client, AMSInstanceID: "instance-id", Retry: policy}, archive
+}
@@ -0,0 +1,108 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenExpiryDelta renews access tokens shortly before they expire, so they don't expire during the upload.
+const tokenExpiryDelta = 30 * time.Second
+
+// ClientCredentials obtains access tokens with the OAuth 2.0 client credentials grant from the token endpoint of the
+// identity tenant. It is used for the DCL upload of identity bindings with a client secret instead of a certificate.
+type ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Client       AMSClient
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type tokenError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// Token returns the cached access token or requests a new one if there is none or it is about to expire.
+func (c *ClientCredentials) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && (c.expires.IsZero() || time.Now().Add(tokenExpiryDelta).Before(c.expires)) {
+		return c.token, nil
+	}
+	resp, err := c.requestToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.token = resp.AccessToken
+	c.expires = time.Time{}
+	if resp.ExpiresIn > 0 {
+		c.expires = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	return c.token, nil
+}
+
+// Invalidate drops the cached access token, so the next call of Token requests a new one.
+func (c *ClientCredentials) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+}
+
+func (c *ClientCredentials) requestToken(ctx context.Context) (*tokenResponse, error) {
+	form := url.Values{"grant_type": {"client_credentials"}, "client_id": {c.ClientID}}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("could not create token request: %w", err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", "application/json")
+	r.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+
+	resp, err := c.Client.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("token request to %s failed: %w", c.TokenURL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var tokenErr tokenError
+		if json.Unmarshal(body, &tokenErr) == nil && tokenErr.Error != "" {
+			if tokenErr.Description != "" {
+				tokenErr.Error += ": " + tokenErr.Description
+			}
+			return nil, fmt.Errorf("token request to %s returned status %s: %s", c.TokenURL, resp.Status, tokenErr.Error)
+		}
+		return nil, fmt.Errorf("token request to %s returned status %s", c.TokenURL, resp.Status)
+	}
+	var token tokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("could not parse token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token response of %s contains no access token", c.TokenURL)
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return nil, fmt.Errorf("unsupported token type %q", token.TokenType)
+	}
+	return &token, nil
+}
@@ -0,0 +1,115 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTokenServer returns a token endpoint that issues the tokens token-1, token-2, ... with the given response
+// template, and a pointer to the number of issued tokens.
+func newTokenServer(t *testing.T, status int, template string) (*httptest.Server, *int) {
+	issued := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/oauth2/token", r.URL.Path)
+		assert.Equal(t, "application/x-www-form-urlencoded", r.Header.Get("Content-Type"))
+		id, secret, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "client-id", id)
+		assert.Equal(t, "s3cr%3Ft", secret) // form-urlencoded as required by RFC 6749
+		assert.Equal(t, "client_credentials", r.PostFormValue("grant_type"))
+		assert.Equal(t, "client-id", r.PostFormValue("client_id"))
+
+		issued++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = fmt.Fprintf(w, template, issued)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &issued
+}
+
+func TestClientCredentialsToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		template   string
+		wantTokens []string
+		wantIssued int
+		wantErr    string
+	}{
+		{name: "token is cached", status: 200, template: `{"access_token":"token-%d","token_type":"bearer","expires_in":3600}`,
+			wantTokens: []string{"token-1", "token-1"}, wantIssued: 1},
+		{name: "token without expiry is cached", status: 200, template: `{"access_token":"token-%d","token_type":"Bearer"}`,
+			wantTokens: []string{"token-1", "token-1"}, wantIssued: 1},
+		{name: "token about to expire is renewed", status: 200, template: `{"access_token":"token-%d","token_type":"bearer","expires_in":10}`,
+			wantTokens: []string{"token-1", "token-2"}, wantIssued: 2},
+		{name: "OAuth error", status: 401, template: `{"error":"invalid_client","error_description":"Client authentication failed %d"}`,
+			wantErr: "returned status 401 Unauthorized: invalid_client: Client authentication failed 1"},
+		{name: "error without body", status: 503, template: `%d`, wantErr: "returned status 503 Service Unavailable"},
+		{name: "no access token", status: 200, template: `{"token_type":"bearer","expires_in":%d}`, wantErr: "contains no access token"},
+		{name: "unsupported token type", status: 200, template: `{"access_token":"token-%d","token_type":"mac"}`, wantErr: `unsupported token type "mac"`},
+		{name: "invalid JSON", status: 200, template: `token-%d`, wantErr: "could not parse token response"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, issued := newTokenServer(t, tt.status, tt.template)
+			creds := &ClientCredentials{TokenURL: srv.URL + "/oauth2/token", ClientID: "client-id", ClientSecret: "s3cr?t", Client: srv.Client()}
+
+			if tt.wantErr != "" {
+				_, err := creds.Token(context.Background())
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			for _, want := range tt.wantTokens {
+				token, err := creds.Token(context.Background())
+				require.NoError(t, err)
+				assert.Equal(t, want, token)
+			}
+			assert.Equal(t, tt.wantIssued, *issued)
+		})
+	}
+}
+
+func TestUploadWithClientCredentials(t *testing.T) {
+	tokenSrv, issued := newTokenServer(t, 200, `{"access_token":"token-%d","token_type":"bearer","expires_in":3600}`)
+	var authHeaders []string
+	amsSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeaders = append(authHeaders, r.Header.Get("Authorization"))
+		if len(authHeaders) == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer amsSrv.Close()
+
+	logs := new(bytes.Buffer)
+	up, archive := newRetryTestUploader(t, logs, amsSrv.Client(), RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	up.Auth = &ClientCredentials{TokenURL: tokenSrv.URL + "/oauth2/token", ClientID: "client-id", ClientSecret: "s3cr?t", Client: tokenSrv.Client()}
+
+	resp, err := up.DoWithRetries(context.Background(), amsSrv.URL+"/dcl-upload", archive)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"Bearer token-1", "Bearer token-2"}, authHeaders)
+	assert.Equal(t, 2, *issued)
+	assert.Contains(t, logs.String(), "access token is not accepted, retrying with a new token after")
+}
+
+func TestUploadFailsWithoutToken(t *testing.T) {
+	tokenSrv, _ := newTokenServer(t, 401, `{"error":"invalid_client","error_description":"attempt %d"}`)
+	up, archive := newRetryTestUploader(t, new(bytes.Buffer), nil, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	up.Auth = &ClientCredentials{TokenURL: tokenSrv.URL + "/oauth2/token", ClientID: "client-id", ClientSecret: "s3cr?t", Client: tokenSrv.Client()}
+
+	_, err := up.DoWithRetries(context.Background(), "https://ams.example.com/dcl-upload", archive)
+	assert.ErrorContains(t, err, "could not get access token for DCL upload: token request to "+tokenSrv.URL+"/oauth2/token returned status 401 Unauthorized: invalid_client: attempt 1")
+}
@@ -1,7 +1,6 @@
 package uploader
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -17,26 +16,45 @@ import (
 )
 
 type Uploader struct {
-	Log           *libbuildpack.Logger
-	Root          string
-	Client        AMSClient
-	AMSInstanceID string
-	ExtraHeaders  map[string]string
+	Log    *libbuildpack.Logger
+	Roots  []string
+	Filter FileFilter
+	// MaxArchiveSize limits the size of the compressed policy archive in bytes, 0 means unlimited.
+	MaxArchiveSize int64
+	Client         AMSClient
+	AMSInstanceID  string
+	ExtraHeaders   map[string]string
+	// CacheDir persists the digest of the last successful upload across stagings, so unchanged policies
+	// are not uploaded again unless ForceUpload is set. Caching is disabled if CacheDir is empty.
+	CacheDir    string
+	ForceUpload bool
+	// Retry is the policy for retrying failed uploads, DefaultRetryPolicy is used if it is not set.
+	Retry RetryPolicy
+	// Report writes the issues of a failed DCL compilation to files, if set.
+	Report *IssueReport
+	// ContextLines is the number of source lines printed around each issue of a failed DCL compilation.
+	ContextLines int
+	// Auth authenticates the upload with a bearer token instead of the client certificate, if set.
+	Auth *ClientCredentials
 }
 
 //go:generate mockgen --build_flags=--mod=mod --destination=../supply/client_mock_test.go --package=supply_test github.com/SAP/cloud-authorization-buildpack/pkg/uploader AMSClient
+//go:generate mockgen --build_flags=--mod=mod --destination=client_mock_test.go --package=uploader github.com/SAP/cloud-authorization-buildpack/pkg/uploader AMSClient
 type AMSClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// GetClient returns a client that authenticates with the given client certificate. Without certificate and key, as
+// for identity bindings with a client secret, the client does not present a certificate.
 func GetClient(cert, key []byte) (AMSClient, error) {
-	crt, err := tls.X509KeyPair(cert, key)
-	if err != nil {
-		return nil, fmt.Errorf("could not load key or certificate: %w", err)
-	}
-
 	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.TLSClientConfig.Certificates = []tls.Certificate{crt}
+	if len(cert) > 0 || len(key) > 0 {
+		crt, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("could not load key or certificate: %w", err)
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{crt}
+	}
 	amsClient :=
 		&http.Client{
 			Transport: transport,
@@ -47,57 +65,77 @@ func GetClient(cert, key []byte) (AMSClient, error) {
 
 func (up *Uploader) Do(ctx context.Context, dstURL string) error {
 	up.Log.Info("creating policy archive..")
-	body, err := CreateArchive(up.Log, up.Root)
+	archive, err := CreateArchive(up.Log, up.Roots, ArchiveOptions{Filter: up.Filter, MaxSize: up.MaxArchiveSize})
 	if err != nil {
 		return fmt.Errorf("could not create policy DCL.tar.gz: %w", err)
 	}
-	u, err := url.Parse(dstURL)
+	defer archive.Close()
+	up.Log.Info("policy archive digest: %s", archive.Digest)
+	if !up.shouldUpload(archive) {
+		return nil
+	}
+	uploadURL, err := up.uploadURL(dstURL)
 	if err != nil {
-		return fmt.Errorf("invalid destination AMS URL ('%s'): %w", dstURL, err)
+		return err
 	}
-	u.Path = path.Join(u.Path, "/sap/ams/v1/ams-instances/", up.AMSInstanceID, "/dcl-upload")
-	resp, err := up.DoWithRetries(ctx, u.String(), body.Bytes(), maxRetries)
+	if timeout := up.retryPolicy().Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	resp, err := up.DoWithRetries(ctx, uploadURL, archive)
 	if err != nil {
 		return fmt.Errorf("could not build upload request: %w", err)
 	}
 	defer resp.Body.Close()
-	return up.logResponse(resp, u.String())
+	if err := up.logResponse(resp, uploadURL); err != nil {
+		return err
+	}
+	if up.CacheDir != "" {
+		if err := up.storeDigest(archive.Digest); err != nil {
+			up.Log.Warning("could not store the digest of the uploaded policies in the staging cache: %s", err)
+		}
+	}
+	return nil
 }
 
-const maxRetries = 12 // max 3min
-var RetryPeriod = 15 * time.Second
+func (up *Uploader) uploadURL(dstURL string) (string, error) {
+	u, err := url.Parse(dstURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid destination AMS URL ('%s'): %w", dstURL, err)
+	}
+	u.Path = path.Join(u.Path, "/sap/ams/v1/ams-instances/", up.AMSInstanceID, "/dcl-upload")
+	return u.String(), nil
+}
 
-func (up *Uploader) DoWithRetries(ctx context.Context, dstURL string, body []byte, maxRetries int) (*http.Response, error) {
-	resp, err := up.do(ctx, dstURL, body)
+func (up *Uploader) do(ctx context.Context, dstURL string, archive *Archive) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, dstURL, archive.Reader())
 	if err != nil {
-		return nil, fmt.Errorf("DCL upload request unsuccessful: %w", err)
+		return nil, fmt.Errorf("could not create DCL upload request %w", err)
 	}
-	for retries := 0; resp.StatusCode == http.StatusUnauthorized && retries < maxRetries; retries++ {
-		if err := drainResponseBody(resp.Body); err != nil {
-			return nil, fmt.Errorf("cannot drain response body: %w", err)
-		}
-		up.Log.Info("certificate is not accepted (yet), retrying after %s...", RetryPeriod.String())
-		time.Sleep(RetryPeriod)
-		resp, err = up.do(ctx, dstURL, body)
+	r.ContentLength = archive.Size
+	r.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(archive.Reader()), nil }
+	r.Header = up.headers(archive)
+	if up.Auth != nil {
+		token, err := up.Auth.Token(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("DCL upload request unsuccessful: %w", err)
+			return nil, fmt.Errorf("could not get access token for DCL upload: %w", err)
 		}
+		r.Header.Set("Authorization", "Bearer "+token)
 	}
-	return resp, nil
+	return up.Client.Do(r)
 }
 
-func (up *Uploader) do(ctx context.Context, dstURL string, body []byte) (*http.Response, error) {
-	r, err := http.NewRequestWithContext(ctx, http.MethodPost, dstURL, bytes.NewReader(body))
-	if err != nil {
-		return nil, fmt.Errorf("could not create DCL upload request %w", err)
-	}
-	r.Header.Set(env.HeaderInstanceID, up.AMSInstanceID)
-	r.Header.Set("Content-Type", "application/gzip")
+func (up *Uploader) headers(archive *Archive) http.Header {
+	h := make(http.Header)
+	h.Set(env.HeaderInstanceID, up.AMSInstanceID)
+	h.Set(env.HeaderDCLDigest, archive.Digest)
+	h.Set("Content-Type", "application/gzip")
 
 	for key, value := range up.ExtraHeaders {
-		r.Header.Set(key, value)
+		h.Set(key, value)
 	}
-	return up.Client.Do(r)
+	return h
 }
 
 func drainResponseBody(body io.ReadCloser) error {
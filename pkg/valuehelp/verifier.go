@@ -0,0 +1,163 @@
+// Package valuehelp lets applications verify that calls of their value-help endpoint are sent by AMS. The buildpack
+// exports the expected issuer and subject of the AMS client certificate from the identity binding in
+// AMS_VALUE_HELP_CERT_ISSUER and AMS_VALUE_HELP_CERT_SUBJECT.
+//
+// The verifier only compares the issuer and subject. The certificate chain must be validated by the TLS server of the
+// app, or by the platform router that forwards the certificate in the X-Forwarded-Client-Cert header. Only trust that
+// header if the router overwrites it, as the Cloud Foundry router does for routes with mTLS.
+package valuehelp
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/SAP/cloud-authorization-buildpack/pkg/common/services"
+)
+
+const (
+	// IssuerEnv contains the expected issuer of the client certificate as JSON object.
+	IssuerEnv = "AMS_VALUE_HELP_CERT_ISSUER"
+	// SubjectEnv contains the expected subject of the client certificate as JSON object.
+	SubjectEnv = "AMS_VALUE_HELP_CERT_SUBJECT"
+	// XFCCHeader is the header in which routers forward the client certificate of a request.
+	XFCCHeader = "X-Forwarded-Client-Cert"
+)
+
+var ErrNoClientCertificate = errors.New("request contains no client certificate")
+
+// Verifier checks the issuer and subject of the client certificate of value-help callbacks.
+type Verifier struct {
+	Issuer  services.DistinguishedName
+	Subject services.DistinguishedName
+}
+
+// FromEnv returns the Verifier for the issuer and subject exported by the buildpack.
+func FromEnv() (*Verifier, error) {
+	var v Verifier
+	for env, name := range map[string]*services.DistinguishedName{IssuerEnv: &v.Issuer, SubjectEnv: &v.Subject} {
+		value := os.Getenv(env)
+		if value == "" {
+			return nil, fmt.Errorf("%s is not set, the identity binding contains no value-help certificate", env)
+		}
+		if err := json.Unmarshal([]byte(value), name); err != nil {
+			return nil, fmt.Errorf("invalid value of %s: %w", env, err)
+		}
+	}
+	return &v, nil
+}
+
+// VerifyCertificate returns an error if the issuer or subject of the certificate is not the expected one.
+func (v *Verifier) VerifyCertificate(cert *x509.Certificate) error {
+	if !v.Issuer.Matches(cert.Issuer) {
+		return fmt.Errorf("client certificate issuer '%s' does not match the expected issuer '%s'", cert.Issuer, v.Issuer)
+	}
+	if !v.Subject.Matches(cert.Subject) {
+		return fmt.Errorf("client certificate subject '%s' does not match the expected subject '%s'", cert.Subject, v.Subject)
+	}
+	return nil
+}
+
+// VerifyRequest verifies the client certificate of the request, see ClientCertificate.
+func (v *Verifier) VerifyRequest(r *http.Request) error {
+	cert, err := ClientCertificate(r)
+	if err != nil {
+		return err
+	}
+	return v.VerifyCertificate(cert)
+}
+
+// ClientCertificate returns the client certificate of the TLS connection, or else the one forwarded in the
+// X-Forwarded-Client-Cert header.
+func ClientCertificate(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0], nil
+	}
+	header := r.Header.Get(XFCCHeader)
+	if header == "" {
+		return nil, ErrNoClientCertificate
+	}
+	cert, err := parseXFCC(header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header: %w", XFCCHeader, err)
+	}
+	return cert, nil
+}
+
+// parseXFCC returns the client certificate of the header, which is either the base64 encoded certificate, as set by
+// the Cloud Foundry router, or the Envoy format with the URL encoded PEM certificate in the Cert key of its first
+// element.
+func parseXFCC(header string) (*x509.Certificate, error) {
+	if der, err := base64.StdEncoding.DecodeString(stripPEM(header)); err == nil {
+		if cert, err := x509.ParseCertificate(der); err == nil {
+			return cert, nil
+		}
+	}
+
+	element := splitQuoted(header, ',')[0]
+	for _, pair := range splitQuoted(element, ';') {
+		key, value, _ := strings.Cut(pair, "=")
+		if !strings.EqualFold(strings.TrimSpace(key), "Cert") {
+			continue
+		}
+		value, err := url.QueryUnescape(unquote(strings.TrimSpace(value)))
+		if err != nil {
+			return nil, fmt.Errorf("could not decode Cert: %w", err)
+		}
+		block, _ := pem.Decode([]byte(value))
+		if block == nil {
+			return nil, errors.New("Cert contains no PEM encoded certificate")
+		}
+		return x509.ParseCertificate(block.Bytes)
+	}
+	return nil, errors.New("header contains no certificate")
+}
+
+// stripPEM removes the PEM header and footer and all whitespace.
+func stripPEM(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "-----BEGIN CERTIFICATE-----")
+	s = strings.TrimSuffix(s, "-----END CERTIFICATE-----")
+	return strings.Join(strings.Fields(s), "")
+}
+
+// splitQuoted splits s at sep, except inside double quotes, where backslash escapes the next character.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	var b strings.Builder
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
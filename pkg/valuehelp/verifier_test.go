@@ -0,0 +1,123 @@
+package valuehelp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	issuerJSON  = `{"Country":["DE"],"Organization":["SAP SE"],"Locality":["Walldorf"],"CommonName":"SAP Cloud Root CA"}`
+	subjectJSON = `{"Country":["DE"],"Organization":["SAP SE"],"OrganizationalUnit":["SAP Cloud Platform Clients","Canary","someuid"],"Locality":["AMS"],"CommonName":"ValueHelpmTLSCert"}`
+)
+
+var (
+	issuer  = pkix.Name{Country: []string{"DE"}, Organization: []string{"SAP SE"}, Locality: []string{"Walldorf"}, CommonName: "SAP Cloud Root CA"}
+	subject = pkix.Name{Country: []string{"DE"}, Organization: []string{"SAP SE"}, OrganizationalUnit: []string{"SAP Cloud Platform Clients", "Canary", "someuid"},
+		Locality: []string{"AMS"}, CommonName: "ValueHelpmTLSCert"}
+)
+
+// newCertificate returns a certificate with the subject, issued by a CA with the issuer name.
+func newCertificate(t *testing.T, issuer, subject pkix.Name) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ca := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: issuer, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	leaf := &x509.Certificate{SerialNumber: big.NewInt(2), Subject: subject, NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	der, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func TestFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		issuer  string
+		subject string
+		wantErr string
+	}{
+		{name: "JSON objects", issuer: issuerJSON, subject: subjectJSON},
+		{name: "missing subject", issuer: issuerJSON, wantErr: "AMS_VALUE_HELP_CERT_SUBJECT is not set"},
+		{name: "invalid issuer", issuer: "CN=SAP Cloud Root CA", subject: subjectJSON, wantErr: "invalid value of AMS_VALUE_HELP_CERT_ISSUER"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(IssuerEnv, tt.issuer)
+			t.Setenv(SubjectEnv, tt.subject)
+
+			v, err := FromEnv()
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, v.Issuer.Matches(issuer))
+			assert.True(t, v.Subject.Matches(subject))
+		})
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	t.Setenv(IssuerEnv, issuerJSON)
+	t.Setenv(SubjectEnv, subjectJSON)
+	v, err := FromEnv()
+	require.NoError(t, err)
+
+	cert := newCertificate(t, issuer, subject)
+	pemCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	otherSubject := newCertificate(t, issuer, pkix.Name{CommonName: "ValueHelpmTLSCert"})
+	otherIssuer := newCertificate(t, pkix.Name{CommonName: "Other CA"}, subject)
+
+	tests := []struct {
+		name    string
+		tls     *x509.Certificate
+		xfcc    string
+		wantErr string
+	}{
+		{name: "TLS client certificate", tls: cert},
+		{name: "XFCC of the Cloud Foundry router", xfcc: base64.StdEncoding.EncodeToString(cert.Raw)},
+		{name: "XFCC with PEM certificate", xfcc: pemCert},
+		{name: "XFCC of Envoy", xfcc: `By=spiffe://cluster.local/ns/app;Hash=abc;Subject="CN=ValueHelpmTLSCert,OU=Canary";Cert="` +
+			url.QueryEscape(pemCert) + `";URI=,By=spiffe://cluster.local/ns/other;Cert="invalid"`},
+		{name: "TLS takes precedence over XFCC", tls: cert, xfcc: base64.StdEncoding.EncodeToString(otherSubject.Raw)},
+		{name: "other subject", tls: otherSubject, wantErr: "client certificate subject 'CN=ValueHelpmTLSCert' does not match the expected subject"},
+		{name: "other issuer", xfcc: base64.StdEncoding.EncodeToString(otherIssuer.Raw), wantErr: "client certificate issuer 'CN=Other CA' does not match the expected issuer"},
+		{name: "no certificate", wantErr: ErrNoClientCertificate.Error()},
+		{name: "XFCC without certificate", xfcc: `By=spiffe://cluster.local/ns/app;Hash=abc`, wantErr: "invalid X-Forwarded-Client-Cert header: header contains no certificate"},
+		{name: "XFCC with invalid certificate", xfcc: `Cert="not-a-certificate"`, wantErr: "Cert contains no PEM encoded certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "https://app.example.com/value-help", nil)
+			if tt.tls != nil {
+				r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tt.tls}}
+			}
+			if tt.xfcc != "" {
+				r.Header.Set(XFCCHeader, tt.xfcc)
+			}
+
+			err := v.VerifyRequest(r)
+			if tt.wantErr != "" {
+				assert.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -1,6 +1,10 @@
 package testdata
 
-import _ "embed"
+import (
+	_ "embed"
+	"path/filepath"
+	"runtime"
+)
 
 //go:embed bindings/env_with_user_provided_service.json
 var EnvWithUserProvidedIAS string
@@ -11,6 +15,9 @@ var EnvWithIASAuthWithClientSecret string
 //go:embed bindings/env_with_ias_auth_x509.json
 var EnvWithIASAuthX509 string
 
+//go:embed bindings/env_with_ias_auth_x509_provided.json
+var EnvWithIASAuthX509Provided string
+
 //go:embed bindings/env_with_ias_auth_x509_expired.json
 var EnvWithIASAuthX509Expired string
 
@@ -22,3 +29,36 @@ var EnvWithMegacliteAndIAS string
 
 //go:embed bindings/env_all_missing.json
 var EnvWithAllMissing string
+
+//go:embed bindings/env_with_multiple_ias.json
+var EnvWithMultipleIAS string
+
+// K8sBindingRoot returns the path of a directory with mounted service bindings, "sapbtp" for the layout of the SAP BTP
+// service operator or "servicebinding" for the servicebinding.io layout.
+func K8sBindingRoot(layout string) string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "k8s", layout)
+}
+
+// Certificates and keys of the bindings, all issued by the same test CA
+
+//go:embed certs/identity.crt
+var IdentityCert string
+
+//go:embed certs/identity.key
+var IdentityKey string
+
+//go:embed certs/expired.crt
+var ExpiredCert string
+
+//go:embed certs/provided.crt
+var ProvidedCert string
+
+//go:embed certs/provided.key
+var ProvidedKey string
+
+//go:embed certs/login.crt
+var LoginCert string
+
+//go:embed certs/login.key
+var LoginKey string